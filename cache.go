@@ -0,0 +1,124 @@
+package influxdb
+
+import (
+	"sync"
+	"time"
+)
+
+// countCache remembers the last count observed for each metric so that
+// per-interval deltas can be derived on the next flush. Entries belonging to
+// metrics that were not seen during a flush are dropped by prune, which keeps
+// the cache from growing when metrics are unregistered. It is safe for
+// concurrent use, as points may be built concurrently.
+type countCache struct {
+	mu     sync.Mutex
+	values map[string]int64
+	seen   map[string]struct{}
+}
+
+func newCountCache() *countCache {
+	return &countCache{
+		values: map[string]int64{},
+		seen:   map[string]struct{}{},
+	}
+}
+
+// swap returns the previously stored count for name, if any, and stores v in
+// its place when commit is set. Without commit the cache is left untouched,
+// which lets points be rendered without affecting the next flush.
+func (c *countCache) swap(name string, v int64, commit bool) (int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prev, ok := c.values[name]
+	if commit {
+		c.seen[name] = struct{}{}
+		c.values[name] = v
+	}
+	return prev, ok
+}
+
+// add returns the count stored for name, zero if none, and increments it by
+// delta when commit is set.
+func (c *countCache) add(name string, delta int64, commit bool) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prev := c.values[name]
+	if commit {
+		c.seen[name] = struct{}{}
+		c.values[name] = prev + delta
+	}
+	return prev
+}
+
+// keep marks the entry of name, if any, as touched without changing it, so that
+// it survives the next prune while its metric is skipped.
+func (c *countCache) keep(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.values[name]; ok {
+		c.seen[name] = struct{}{}
+	}
+}
+
+// prune forgets every entry that was not touched since the previous prune.
+func (c *countCache) prune() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name := range c.values {
+		if _, ok := c.seen[name]; !ok {
+			delete(c.values, name)
+		}
+	}
+	c.seen = map[string]struct{}{}
+}
+
+// gaugeAggregates aggregates the values of the gauges reported by the flushes
+// sharing an aligned timestamp, so that the last flush writes their max or
+// mean rather than overwriting the values of the previous ones. The values of
+// a timestamp are forgotten once a flush has another one.
+type gaugeAggregates struct {
+	mu     sync.Mutex
+	mean   bool
+	ts     time.Time
+	values map[string]gaugeAggregate
+}
+
+type gaugeAggregate struct {
+	max float64
+	sum float64
+	n   int
+}
+
+func newGaugeAggregates(mean bool) *gaugeAggregates {
+	return &gaugeAggregates{
+		mean:   mean,
+		values: map[string]gaugeAggregate{},
+	}
+}
+
+// add returns the max or mean of v and the values of name previously added
+// at ts. v is only stored when commit is set.
+func (g *gaugeAggregates) add(name string, ts time.Time, v float64, commit bool) float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var a gaugeAggregate
+	if ts.Equal(g.ts) {
+		a = g.values[name]
+	}
+	if a.n == 0 || v > a.max {
+		a.max = v
+	}
+	a.sum += v
+	a.n++
+	if commit {
+		if !ts.Equal(g.ts) {
+			g.ts = ts
+			g.values = map[string]gaugeAggregate{}
+		}
+		g.values[name] = a
+	}
+	if g.mean {
+		return a.sum / float64(a.n)
+	}
+	return a.max
+}
@@ -0,0 +1,120 @@
+package influxdb
+
+import (
+	"context"
+	"errors"
+	"net"
+	nethttp "net/http"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/http"
+	"github.com/influxdata/influxdb-client-go/v2/domain"
+)
+
+// checkDestination verifies that InfluxDB is reachable and that the org and
+// bucket exist. Asynchronous writes to a wrong org or bucket otherwise fail
+// without any visible signal, so this is done once before the first flush and
+// logs what is wrong, telling authentication problems apart from
+// connectivity problems.
+func (r *Reporter) checkDestination(ctx context.Context) {
+	if r.v3 || r.sink != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, r.writeTimeout)
+	defer cancel()
+
+	health, err := r.client.Health(ctx)
+	if err != nil {
+		r.logf("unable to reach InfluxDB at %s. err=%v", r.url.String(), err)
+		return
+	}
+	if health.Status != domain.HealthCheckStatusPass {
+		r.logf("InfluxDB at %s is not healthy. status=%s", r.url.String(), health.Status)
+	}
+	if r.org == "" || r.org == "-" {
+		// InfluxDB 1.8 compatibility mode has no org or bucket API.
+		return
+	}
+
+	org, err := r.client.OrganizationsAPI().FindOrganizationByName(ctx, r.org)
+	if err != nil {
+		r.logCheckError("org", r.org, err)
+		return
+	}
+	if _, err := r.client.BucketsAPI().FindBucketByName(ctx, r.bucket); err != nil {
+		if r.createBucket && !isAuthError(err) && !isConnectivityError(err) {
+			r.makeBucket(ctx, org)
+			return
+		}
+		r.logCheckError("bucket", r.bucket, err)
+	}
+}
+
+// makeBucket creates the missing bucket in org, with the retention set by
+// WithBucketCreate.
+func (r *Reporter) makeBucket(ctx context.Context, org *domain.Organization) {
+	if org.Id == nil {
+		r.logf("unable to create bucket %q, org %q has no ID", r.bucket, r.org)
+		return
+	}
+	var rules []domain.RetentionRule
+	if r.bucketRetention > 0 {
+		rules = append(rules, domain.RetentionRule{
+			Type:         domain.RetentionRuleTypeExpire,
+			EverySeconds: int(r.bucketRetention.Seconds()),
+		})
+	}
+	if _, err := r.client.BucketsAPI().CreateBucketWithNameWithID(ctx, *org.Id, r.bucket, rules...); err != nil {
+		if isAuthError(err) {
+			r.logf("InfluxDB rejected creating bucket %q, the token needs the permission to write buckets. err=%v", r.bucket, err)
+			return
+		}
+		r.logf("unable to create bucket %q. err=%v", r.bucket, err)
+		return
+	}
+	r.logf("created bucket %q in org %q", r.bucket, r.org)
+}
+
+func (r *Reporter) logCheckError(kind, name string, err error) {
+	switch {
+	case isAuthError(err):
+		r.logf("InfluxDB rejected the token while looking up %s %q, check the token and its permissions. err=%v", kind, name, err)
+	case isConnectivityError(err):
+		r.logf("unable to reach InfluxDB while looking up %s %q. err=%v", kind, name, err)
+	default:
+		r.logf("%s %q not found in InfluxDB, points will not be stored. err=%v", kind, name, err)
+	}
+}
+
+// isAuthError reports whether err is an authentication or authorization
+// failure returned by InfluxDB.
+func isAuthError(err error) bool {
+	var herr *http.Error
+	if !errors.As(err, &herr) {
+		return false
+	}
+	return herr.StatusCode == nethttp.StatusUnauthorized || herr.StatusCode == nethttp.StatusForbidden
+}
+
+// isConnectivityError reports whether err means InfluxDB could not be reached.
+func isConnectivityError(err error) bool {
+	var nerr net.Error
+	if errors.As(err, &nerr) {
+		return true
+	}
+	var herr *http.Error
+	return errors.As(err, &herr) && herr.StatusCode == 0
+}
+
+// isRetryableError is the default retryable error func: server errors, rate
+// limiting and connectivity errors are worth retrying, other client errors
+// such as a malformed write would fail identically.
+func isRetryableError(err error) bool {
+	if isConnectivityError(err) {
+		return true
+	}
+	var herr *http.Error
+	if !errors.As(err, &herr) {
+		return false
+	}
+	return herr.StatusCode >= 500 || herr.StatusCode == nethttp.StatusTooManyRequests
+}
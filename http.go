@@ -0,0 +1,36 @@
+package influxdb
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// ServeHTTP renders the current contents of the registry as line protocol,
+// using the same naming and tagging as the points written to InfluxDB, so
+// that an agent such as Telegraf can scrape the reporter instead of it
+// pushing to InfluxDB. Rendering does not affect the values reported by the
+// next flush; metrics sampled with WithSampleRate are always rendered.
+func (r *Reporter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if req.Method == http.MethodHead {
+		return
+	}
+	b := r.points(r.timestamp(), false)
+	points := b.points
+	for _, routed := range b.routed {
+		points = append(points, routed...)
+	}
+	for _, p := range points {
+		if _, err := w.Write([]byte(write.PointToLineProtocol(p, time.Nanosecond))); err != nil {
+			return
+		}
+	}
+}
@@ -2,207 +2,1015 @@ package influxdb
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"math/rand"
 	uurl "net/url"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 
 	client "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
 	"github.com/rcrowley/go-metrics"
 )
 
-type reporter struct {
-	reg      metrics.Registry
-	interval time.Duration
-	align    bool
-	url      uurl.URL
-	bucket   string
+// Registry is the part of metrics.Registry the reporter depends on: it only
+// iterates the metrics with Each. Any metrics.Registry satisfies it, as do
+// wrappers filtering or renaming the metrics of another registry.
+type Registry interface {
+	Each(func(name string, metric interface{}))
+}
+
+// ErrAlreadyStarted is returned when Start or Run is called on a Reporter
+// whose reporting loop has already been started.
+var ErrAlreadyStarted = errors.New("influxdb: reporter already started")
+
+// defaultReadyTimeout bounds the periodic ping unless set with
+// WithReadyTimeout.
+const defaultReadyTimeout = 3 * time.Second
+
+// defaultQueueLimit bounds the queue of Enqueue unless set with
+// WithEnqueueLimit.
+const defaultQueueLimit = 10000
+
+// Reporter posts the metrics of a registry to InfluxDB at a fixed interval.
+//
+// A Reporter runs a single reporting loop: it must be started exactly once,
+// either in the background with Start or in the calling goroutine with Run.
+type Reporter struct {
+	// 64-bit atomic counters come first to keep them aligned on 32-bit platforms.
+	droppedPoints  int64
+	skippedTicks   int64
+	rejectedPoints int64
+	clampedValues  int64
+
+	// skippedTicksReg, when set, is the registry of the skipped ticks gauge.
+	skippedTicksReg  metrics.Registry
+	skippedTicksName string
+
+	// mu guards the connection settings and the client.
+	mu sync.RWMutex
+
+	reg Registry
+	// registries holds the registries added with WithRegistry.
+	registries []registry
+	interval   time.Duration
+	align      bool
+	// alignMode selects how timestamps are aligned when align is set.
+	alignMode AlignMode
+	// seconds truncates timestamps to the second and writes them with a
+	// second precision.
+	seconds bool
+	// alignCollision selects how gauges are reported by flushes sharing an
+	// aligned timestamp, gaugeAggregates holding their values when they are
+	// aggregated and lastGaugeTime the timestamp of the previous offset ones.
+	alignCollision  AlignCollision
+	gaugeAggregates *gaugeAggregates
+	lastGaugeTime   time.Time
+
+	url       uurl.URL
+	bucket    string
+	org       string
+	token     string
+	tokenFile string
+	// tlsConfig, when set, is the TLS configuration of the connections.
+	tlsConfig *tls.Config
+	// retentionPolicy, when set, is the retention policy written to on 1.8.
+	retentionPolicy string
+	// consistency, when set, is the write consistency of InfluxDB Enterprise.
+	consistency string
+	// createBucket creates the bucket, with bucketRetention, if missing.
+	createBucket    bool
+	bucketRetention time.Duration
 
 	measurement string
-	org         string
-	token       string
-	tags        map[string]string
+	// statsMeasurementName, when set, is the measurement of the per-statistic points.
+	statsMeasurementName string
+	// sharedMeasurement, when measurementTagKey is set, is the measurement of
+	// every point, the logical measurement being stored in that tag.
+	sharedMeasurement string
+	measurementTagKey string
+	// prefixDepth, when set, is the number of leading segments of metric
+	// names making up their measurement.
+	prefixDepth int
+	// measurementSanitizer is applied to the measurement of every point.
+	measurementSanitizer func(string) string
+
+	tags map[string]string
+	// reporterTags are only attached to the points about the reporter itself.
+	reporterTags map[string]string
+	// optInTags are the keys of tags only attached to the metrics optInAllow accepts.
+	optInTags  []string
+	optInAllow func(metric, tag string) bool
+
+	// pointsMu serializes building points, which reads and updates the caches below.
+	pointsMu sync.Mutex
+	// concurrency is the number of goroutines building points.
+	concurrency int
+	// snapshotRegistry collects the metrics before reading them.
+	snapshotRegistry bool
+	// meterRates caches meter counts for the rate_interval field, nil when disabled.
+	meterRates *countCache
+	// meterRateTimes caches the time, in Unix nanoseconds, of the counts of
+	// meterRates, nil when disabled.
+	meterRateTimes *countCache
+	// idleCounts caches histogram/timer counts to skip idle distributions, nil when disabled.
+	idleCounts *countCache
+	// counterDeltas caches counter counts to report deltas, nil when disabled.
+	counterDeltas *countCache
+	// counterTotals caches counter counts to report their deltas along with
+	// their count, nil when disabled.
+	counterTotals *countCache
+	// meterDeltas caches meter counts to report count deltas, nil when disabled.
+	meterDeltas *countCache
+	// gaugeDeltas caches the values of the gauges gaugeDeltaFunc selects to
+	// report deltas, nil when disabled.
+	gaugeDeltas    *countCache
+	gaugeDeltaFunc func(name string) bool
+	// flushCounts counts the flushes of the metrics reported only every
+	// few flushes, nil when disabled.
+	flushCounts *countCache
+	everyNames  map[string]int64
+	everyTypes  map[MetricType]int64
+	// changeHashes and changeTimes hold the hash of the fields of each metric
+	// and when they were last written, nil unless only changes are written.
+	changeHashes  *countCache
+	changeTimes   *countCache
+	maxStale      time.Duration
+	lastDeltaTime time.Time
+	// unalignedCounters timestamps counter and delta points with the
+	// unaligned time of the flush.
+	unalignedCounters bool
+	// created is the start of the interval of the first counter deltas.
+	created time.Time
+	// clock returns the current time of flushes, time.Now outside of tests.
+	clock           func() time.Time
+	intervalSeconds bool
+
+	// typeBuckets routes the points of metric types to other buckets.
+	typeBuckets map[MetricType]string
+	// enabledTypes, when set, holds the only metric types reported, unless
+	// also in disabledTypes.
+	enabledTypes  map[MetricType]bool
+	disabledTypes map[MetricType]bool
+	// allowlist, when set, holds the names of the only metrics reported.
+	allowlist      map[string]bool
+	gaugeFieldType FieldType
+	// fieldTypes coerces the values of fields by key.
+	fieldTypes map[string]FieldType
+	// typePrecision and fieldPrecision hold the decimal places float fields
+	// are rounded to by metric type and by key, the key taking precedence.
+	typePrecision map[MetricType]int
+	// fieldBlocklist holds the suffixes of the fields never written.
+	fieldBlocklist []string
+	fieldPrecision map[string]int
+	// clamp bounds float field values to [clampMin, clampMax].
+	clamp              bool
+	clampMin, clampMax float64
+	// maxPointSize, when set, is the size of the largest point written.
+	maxPointSize  int
+	floatCounters bool
+	noTimerRates  bool
+	// splitTimers writes the distribution and the rates of timers like those
+	// of histograms and meters, to their own measurements.
+	splitTimers           bool
+	timerDistMeasurement  string
+	timerRatesMeasurement string
+	// counterField and gaugeField are the field key suffixes of counters and
+	// gauges.
+	counterField string
+	gaugeField   string
+	// healthErrorLen caps the error tag of unhealthy healthchecks.
+	healthErrorLen int
+	// runHealthchecks runs the healthchecks at every flush.
+	runHealthchecks bool
+	omitStats       map[string]bool
+	statNames       map[string]string
+	// histogramBounds, when set, are the upper bounds of the cumulative
+	// buckets written for histograms.
+	histogramBounds  []float64
+	maxBucketSamples int
+	// quantileTag, when set, is the tag holding the quantile of percentiles.
+	quantileTag string
+	// nameTag, when set, is the key of a tag holding the metric name.
+	nameTag         string
+	defaultFieldKey string
+	// fieldTemplate, when set, produces the field keys, fieldTmpl being its
+	// parsed form.
+	fieldTemplate string
+	fieldTmpl     *template.Template
+	// counterPatterns extract the measurement and tags of counters from their
+	// name, counterRules being their compiled form.
+	counterPatterns []string
+	counterRules    []*regexp.Regexp
+	// stripPrefix is removed from the name of every metric.
+	stripPrefix string
+	// metricTimeout bounds the evaluation of functional gauges, 0 if unbounded.
+	metricTimeout time.Duration
+	// orderedFields sorts the fields of the written points by key.
+	orderedFields bool
+	// sendContext, when set, derives the context of each flush and returns
+	// the function told about its outcome.
+	sendContext func(ctx context.Context) (context.Context, func(error))
+	// preWrite, when set, replaces the points of each flush before they are
+	// written.
+	preWrite func([]*write.Point) []*write.Point
+	// exportField, when set, is the field holding the time of the flush in
+	// epoch milliseconds.
+	exportField  string
+	nameRewriter func(string) string
+	// sampleRates holds the probability a metric is reported at each flush.
+	sampleRates   map[string]float64
+	rand          *rand.Rand
+	timestampFunc func(name string, metric interface{}) (time.Time, bool)
+
+	metricErrorHandler func(name string, err error)
+
+	name          string
+	writeCallback func(points int, took time.Duration)
+	heartbeat     string
+
+	infoTags        map[string]string
+	infoMeasurement string
+	// infoWritten is set once a flush holding the info point was written,
+	// i.e. handed over with the asynchronous write API.
+	infoWritten bool
+	// scrapeMeasurement, when set, receives the duration and success of flushes.
+	scrapeMeasurement string
+	// registrySize writes the number of metrics of the registries.
+	registrySize bool
+
+	// queue holds the points of Enqueue, and records the line protocol
+	// records of EnqueueRecords, until the next flush.
+	queueMu    sync.Mutex
+	queue      []*write.Point
+	records    []string
+	queueLimit int
+
+	// debugWriter, when set, receives the line protocol of every flush.
+	debugWriter io.Writer
+	// jsonDebugWriter, when set, receives the points of every flush as JSON.
+	jsonDebugWriter io.Writer
+	writeTimeout    time.Duration
+	// writeTimeoutFraction, when set, derives writeTimeout from the interval.
+	writeTimeoutFraction float64
+	readyTimeout         time.Duration
+	// startTimeout, when set, bounds the check that InfluxDB is ready made by
+	// New, which fails unless lazyStart is set.
+	startTimeout time.Duration
+	lazyStart    bool
+	writing      int32
 
 	client client.Client
+	// writer is the write path, through client, to InfluxDB 3 or to sink.
+	writer writer
+	v3     bool
+	sink   Sink
+	// writeAPIs caches the write APIs of the current client by destination.
+	writeAPIs map[writeTarget]api.WriteAPI
+	// handOverDone is closed once the last hand-over to a write API is over.
+	handOverDone chan struct{}
+	errorHandler func(error)
+	skipErrors   bool
+	// retries is the number of times a failed write is retried, if retryable
+	// accepts its error.
+	retries      int
+	retryBackoff time.Duration
+	retryable    func(error) bool
+	// bucketProvider, when set, resolves the destination at every flush.
+	bucketProvider func() (org, bucket string)
+
+	// baseCtx is the parent of the contexts of the requests made to InfluxDB,
+	// independent of the lifetime of the reporting loop.
+	baseCtx       context.Context
+	flushRequests chan struct{}
+	// reconnects asks the reporting loop to recreate the client, for the
+	// given failure if any.
+	reconnects   chan string
+	minInterval  time.Duration
+	startupFlush bool
+	// deadline, when set, stops the reporting loop.
+	deadline time.Time
+	// shutdownTimeout, when set, bounds the final flush and close.
+	shutdownTimeout time.Duration
+	onReconnect     func(reason string)
+	panicHandler    func(interface{})
+	// sendFailures throttles the logging of failed sends, asynchronous
+	// writes and pings.
+	sendFailures failureLog
+
+	errMu       sync.Mutex
+	lastErr     error
+	lastErrTime time.Time
+
+	started int32
+	checked bool
+	cancel  context.CancelFunc
+	// done is closed once the reporting loop has exited.
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 // InfluxDB starts a InfluxDB reporter which will post the metrics from the given registry at each d interval.
-func InfluxDB(ctx context.Context, r metrics.Registry, d time.Duration, url, bucket, measurement, org, token string, align bool) {
-	InfluxDBWithTags(ctx, r, d, url, bucket, measurement, org, token, map[string]string{}, align)
+func InfluxDB(ctx context.Context, r Registry, d time.Duration, url, bucket, measurement, org, token string, align bool, opts ...Option) {
+	InfluxDBWithTags(ctx, r, d, url, bucket, measurement, org, token, map[string]string{}, align, opts...)
 }
 
 // InfluxDBWithTags starts a InfluxDB reporter which will post the metrics from the given registry at each d interval with the specified tags
-func InfluxDBWithTags(ctx context.Context, r metrics.Registry, d time.Duration, url, bucket, measurement, org, token string, tags map[string]string, align bool) {
-	u, err := uurl.Parse(url)
+func InfluxDBWithTags(ctx context.Context, r Registry, d time.Duration, url, bucket, measurement, org, token string, tags map[string]string, align bool, opts ...Option) {
+	opts = append([]Option{WithTags(tags)}, opts...)
+	if align {
+		opts = append(opts, WithAlign())
+	}
+	rep, err := New(r, d, url, bucket, measurement, org, token, opts...)
 	if err != nil {
-		log.Printf("unable to parse InfluxDB url %s. err=%v", url, err)
+		log.Printf("unable to create InfluxDB reporter. err=%v", err)
 		return
 	}
 
-	rep := &reporter{
-		reg:         r,
-		interval:    d,
-		url:         *u,
-		bucket:      bucket,
-		measurement: measurement,
-		org:         org,
-		token:       token,
-		tags:        tags,
-		align:       align,
+	rep.Run(ctx)
+}
+
+// New creates a Reporter which will post the metrics from the given registry at each d interval.
+// The reporter does nothing until Start or Run is called.
+func New(r Registry, d time.Duration, url, bucket, measurement, org, token string, opts ...Option) (*Reporter, error) {
+	u, err := uurl.Parse(url)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse InfluxDB url %s: %w", url, err)
+	}
+
+	rep := &Reporter{
+		reg:                  r,
+		interval:             d,
+		url:                  *u,
+		bucket:               bucket,
+		measurement:          measurement,
+		org:                  org,
+		token:                token,
+		tags:                 map[string]string{},
+		baseCtx:              context.Background(),
+		created:              time.Now(),
+		clock:                time.Now,
+		measurementSanitizer: sanitizeMeasurement,
+		counterField:         "count",
+		gaugeField:           "gauge",
+		queueLimit:           defaultQueueLimit,
+		retryBackoff:         time.Second,
+		retryable:            isRetryableError,
+		healthErrorLen:       64,
+
+		flushRequests: make(chan struct{}, 1),
+		reconnects:    make(chan string, 1),
+		done:          make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(rep)
+	}
+	if rep.writeTimeoutFraction > 0 {
+		rep.writeTimeout = time.Duration(float64(d) * rep.writeTimeoutFraction)
+	}
+	if rep.writeTimeout <= 0 {
+		rep.writeTimeout = d
+	}
+	if rep.readyTimeout <= 0 {
+		rep.readyTimeout = defaultReadyTimeout
+	}
+	if rep.healthErrorLen < 0 {
+		return nil, fmt.Errorf("influxdb: negative healthcheck error length %d", rep.healthErrorLen)
+	}
+	if rep.fieldTemplate != "" {
+		tmpl, err := template.New("field").Parse(rep.fieldTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("influxdb: invalid field template: %w", err)
+		}
+		if err := tmpl.Execute(ioutil.Discard, fieldData{}); err != nil {
+			return nil, fmt.Errorf("influxdb: invalid field template: %w", err)
+		}
+		rep.fieldTmpl = tmpl
+	}
+	if rep.align && (rep.alignCollision == AlignCollisionMax || rep.alignCollision == AlignCollisionMean) {
+		rep.gaugeAggregates = newGaugeAggregates(rep.alignCollision == AlignCollisionMean)
+	}
+	for _, pattern := range rep.counterPatterns {
+		rule, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("influxdb: invalid counter name pattern: %w", err)
+		}
+		if !hasGroup(rule, "measurement") {
+			return nil, fmt.Errorf("influxdb: counter name pattern %q has no measurement group", pattern)
+		}
+		rep.counterRules = append(rep.counterRules, rule)
+	}
+	if rep.defaultFieldKey != "" && rep.nameTag == "" {
+		rep.nameTag = "name"
+	}
+	if rep.rand == nil {
+		rep.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	if rep.tokenFile != "" {
+		if rep.token, err = readToken(rep.tokenFile); err != nil {
+			return nil, err
+		}
+	}
+	if rep.tlsConfig != nil && rep.tlsConfig.InsecureSkipVerify {
+		rep.logf("WARNING: TLS certificate verification of %s is disabled, connections can be intercepted", rep.url.Host)
+	}
+	if rep.consistency != "" && (rep.sink != nil || rep.v3) {
+		rep.logf("WARNING: the write consistency %s is ignored, it is only supported by the InfluxDB 2 client", rep.consistency)
 	}
 	rep.makeClient()
+	switch {
+	case rep.sink != nil:
+		rep.writer = sinkWriter{sink: rep.sink}
+	case rep.v3:
+		rep.writer = newV3Writer(rep)
+	default:
+		// See v2Writer for the options needing blocking writes.
+		blocking := rep.retries > 0 || rep.writeCallback != nil || rep.scrapeMeasurement != ""
+		rep.writer = v2Writer{r: rep, blocking: blocking}
+	}
+	if rep.startTimeout > 0 {
+		ctx, cancel := context.WithTimeout(rep.baseCtx, rep.startTimeout)
+		err := rep.Ping(ctx)
+		cancel()
+		if err != nil && !rep.lazyStart {
+			rep.writer.close()
+			return nil, fmt.Errorf("influxdb: unable to reach InfluxDB at startup: %w", err)
+		}
+		if err != nil {
+			rep.logf("unable to reach InfluxDB at startup, connecting on the first flush. err=%v", err)
+		}
+	}
+	if rep.skippedTicksReg != nil {
+		rep.skippedTicksReg.GetOrRegister(rep.skippedTicksName, metrics.NewFunctionalGauge(rep.SkippedTicks))
+	}
 
-	rep.run(ctx)
+	return rep, nil
 }
 
-func (r *reporter) makeClient() {
-	r.client = client.NewClient(r.url.String(), r.token)
+// Start runs the reporting loop in a new goroutine until ctx is done or Stop
+// is called. It returns ErrAlreadyStarted if the reporter was already started.
+func (r *Reporter) Start(ctx context.Context) error {
+	ctx, err := r.begin(ctx)
+	if err != nil {
+		return err
+	}
+	go r.run(ctx)
+	return nil
+}
 
+// Run runs the reporting loop in the calling goroutine until ctx is done or
+// Stop is called. It returns ErrAlreadyStarted if the reporter was already
+// started.
+func (r *Reporter) Run(ctx context.Context) error {
+	ctx, err := r.begin(ctx)
+	if err != nil {
+		return err
+	}
+	r.run(ctx)
+	return nil
 }
 
-func (r *reporter) run(ctx context.Context) {
-	intervalTicker := time.Tick(r.interval)
-	pingTicker := time.Tick(time.Second * 5)
+// Stop stops the reporting loop. The loop performs a final flush and closes
+// the client before exiting, Stop does not wait for it: use StopAndWait for
+// that.
+func (r *Reporter) Stop() {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.cancel != nil {
+		r.cancel()
+	}
+}
 
-	for {
+// StopAndWait stops the reporting loop and waits until it has performed its
+// final flush, closed the client and exited, or until ctx is done, in which
+// case it returns the error of ctx. It returns immediately if the reporter
+// was never started.
+func (r *Reporter) StopAndWait(ctx context.Context) error {
+	r.Stop()
+	if atomic.LoadInt32(&r.started) == 0 {
+		return nil
+	}
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// begin marks the reporter as started and derives the context of the
+// reporting loop, canceled by Stop or when the deadline set by WithDeadline
+// passes.
+func (r *Reporter) begin(ctx context.Context) (context.Context, error) {
+	if !atomic.CompareAndSwapInt32(&r.started, 0, 1) {
+		return nil, ErrAlreadyStarted
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.deadline.IsZero() {
+		ctx, r.cancel = context.WithCancel(ctx)
+	} else {
+		ctx, r.cancel = context.WithDeadline(ctx, r.deadline)
+	}
+	return ctx, nil
+}
+
+// Endpoint returns the InfluxDB url the reporter writes to, as re-stringified after parsing.
+func (r *Reporter) Endpoint() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.url.String()
+}
+
+// Bucket returns the bucket the reporter writes to.
+func (r *Reporter) Bucket() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.bucket
+}
+
+// Org returns the organization the reporter writes to.
+func (r *Reporter) Org() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.org
+}
+
+// Measurement returns the measurement of the reported points.
+func (r *Reporter) Measurement() string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.measurement
+}
+
+// Ping checks that InfluxDB is reachable and ready to accept writes, using
+// the reporter's url and credentials, e.g. for an application health check.
+func (r *Reporter) Ping(ctx context.Context) error {
+	ready, err := r.writer.ready(ctx)
+	if err != nil {
+		return err
+	}
+	if !ready {
+		return errors.New("influxdb: server is not ready")
+	}
+	return nil
+}
+
+// LastError returns the most recent write or ping error and the time it
+// occurred, or a nil error if none occurred yet.
+func (r *Reporter) LastError() (error, time.Time) {
+	r.errMu.Lock()
+	defer r.errMu.Unlock()
+	return r.lastErr, r.lastErrTime
+}
+
+func (r *Reporter) recordError(err error) {
+	r.errMu.Lock()
+	defer r.errMu.Unlock()
+	r.lastErr, r.lastErrTime = err, time.Now()
+}
+
+// logf logs a message, prefixed with the reporter name if one was set.
+func (r *Reporter) logf(format string, args ...interface{}) {
+	if r.name != "" {
+		format = "[" + r.name + "] " + format
+	}
+	log.Printf(format, args...)
+}
+
+// readToken reads an InfluxDB token from path, e.g. a mounted secret.
+func readToken(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("unable to read InfluxDB token file %s: %w", path, err)
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", fmt.Errorf("InfluxDB token file %s is empty", path)
+	}
+	return token, nil
+}
+
+// reloadToken re-reads the token file, if any, to pick up a rotated token.
+// The current token is kept if the file cannot be read.
+func (r *Reporter) reloadToken() {
+	if r.tokenFile == "" {
+		return
+	}
+	token, err := readToken(r.tokenFile)
+	if err != nil {
+		r.logf("keeping the current token. err=%v", err)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.token = token
+}
+
+// SetToken replaces the InfluxDB token, e.g. after it was rotated. The client
+// is recreated with the new token by the reporting loop.
+func (r *Reporter) SetToken(token string) {
+	r.mu.Lock()
+	r.token = token
+	r.mu.Unlock()
+	r.requestReconnect("")
+}
+
+// checkAuth reacts to an authentication failure, as opposed to connectivity
+// errors, by re-reading the token file so that a rotated token is picked up
+// without a restart.
+func (r *Reporter) checkAuth(err error) {
+	if r.tokenFile == "" || !isAuthError(err) {
+		return
+	}
+	r.logf("InfluxDB rejected the token, reloading it from %s", r.tokenFile)
+	r.reloadToken()
+	r.requestReconnect("InfluxDB rejected the token")
+}
+
+// requestReconnect asks the reporting loop to recreate the client because of
+// the given failure, or "" when it is not recreated because of a failure.
+func (r *Reporter) requestReconnect(reason string) {
+	select {
+	case r.reconnects <- reason:
+	default:
+	}
+}
+
+// reconnect recreates the client, telling the reconnect callback about the
+// failure which caused it.
+func (r *Reporter) reconnect(reason string) {
+	r.makeClient()
+	if reason != "" && r.onReconnect != nil {
+		r.onReconnect(reason)
+	}
+}
+
+// makeClient creates the client, closing the one it replaces.
+func (r *Reporter) makeClient() {
+	opts := client.DefaultOptions().SetTLSConfig(r.tlsConfig)
+	if r.seconds {
+		opts.SetPrecision(time.Second)
+	}
+	if r.consistency != "" {
+		opts.SetHTTPClient(consistencyClient(r.consistency, opts))
+	}
+	r.mu.Lock()
+	old, pending := r.client, r.handOverDone
+	r.client = client.NewClientWithOptions(r.url.String(), r.token, opts)
+	r.writeAPIs = map[writeTarget]api.WriteAPI{}
+	r.mu.Unlock()
+	if old == nil {
+		return
+	}
+	// Closing the replaced client ends the goroutines of its write APIs. It
+	// flushes their buffers, which blocks while InfluxDB is unreachable, so
+	// it is done in the background, once a hand-over to it is over.
+	go func() {
+		if pending != nil {
+			<-pending
+		}
+		old.Close()
+	}()
+}
+
+// run runs the reporting loop until ctx is done. A panic in the loop is
+// recovered, passed to the panic handler and logged with its stack trace,
+// then the loop is restarted after a growing delay.
+func (r *Reporter) run(ctx context.Context) {
+	defer close(r.done)
+
+	backoff := time.Second
+	for !r.loop(ctx) {
 		select {
-		case <-intervalTicker:
-			if err := r.send(); err != nil {
-				log.Printf("unable to send metrics to InfluxDB. err=%v", err)
-			}
-		case <-pingTicker:
-			isReady, err := r.client.Ready(ctx)
-			if err != nil || isReady == false {
-				log.Printf("got error while sending a ping to InfluxDB, trying to recreate client. err=%v", err)
-				r.makeClient()
-			}
+		case <-ctx.Done():
+			r.shutdown()
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > time.Minute {
+			backoff = time.Minute
 		}
 	}
 }
 
-func (r *reporter) send() error {
-	writeAPI := r.client.WriteAPI(r.org, r.bucket)
-
-	now := time.Now()
-	if r.align {
-		now = now.Truncate(r.interval)
-	}
-	r.reg.Each(func(name string, i interface{}) {
-
-		switch metric := i.(type) {
-		case metrics.Counter:
-			ms := metric.Snapshot()
-			p := client.NewPoint(r.measurement,
-				r.tags,
-				map[string]interface{}{
-					fmt.Sprintf("%s.count", name): ms.Count(),
-				},
-				now)
-			writeAPI.WritePoint(p)
-		case metrics.Gauge:
-			ms := metric.Snapshot()
-			p := client.NewPoint(r.measurement,
-				r.tags,
-				map[string]interface{}{
-					fmt.Sprintf("%s.gauge", name): ms.Value(),
-				},
-				now)
-			writeAPI.WritePoint(p)
-		case metrics.GaugeFloat64:
-			ms := metric.Snapshot()
-			p := client.NewPoint(r.measurement,
-				r.tags,
-				map[string]interface{}{
-					fmt.Sprintf("%s.gauge", name): ms.Value(),
-				},
-				now)
-			writeAPI.WritePoint(p)
-		case metrics.Histogram:
-			ms := metric.Snapshot()
-			ps := ms.Percentiles([]float64{0.5, 0.75, 0.95, 0.99, 0.999, 0.9999})
-			fields := map[string]float64{
-				"count":    float64(ms.Count()),
-				"max":      float64(ms.Max()),
-				"mean":     ms.Mean(),
-				"min":      float64(ms.Min()),
-				"stddev":   ms.StdDev(),
-				"variance": ms.Variance(),
-				"p50":      ps[0],
-				"p75":      ps[1],
-				"p95":      ps[2],
-				"p99":      ps[3],
-				"p999":     ps[4],
-				"p9999":    ps[5],
-			}
-			for k, v := range fields {
-				p := client.NewPoint(r.measurement,
-					bucketTags(k, r.tags),
-					map[string]interface{}{
-						fmt.Sprintf("%s.histogram", name): v,
-					},
-					now)
-				writeAPI.WritePoint(p)
-			}
-		case metrics.Meter:
-			ms := metric.Snapshot()
-			fields := map[string]float64{
-				"count": float64(ms.Count()),
-				"m1":    ms.Rate1(),
-				"m5":    ms.Rate5(),
-				"m15":   ms.Rate15(),
-				"mean":  ms.RateMean(),
-			}
-			for k, v := range fields {
-				p := client.NewPoint(r.measurement,
-					bucketTags(k, r.tags),
-					map[string]interface{}{
-						fmt.Sprintf("%s.meter", name): v,
-					},
-					now)
-				writeAPI.WritePoint(p)
-			}
+// loop runs the reporting loop, returning true once ctx is done or false if
+// the loop panicked.
+func (r *Reporter) loop(ctx context.Context) (exited bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			r.logf("reporting loop panicked, restarting it. err=%v\n%s", err, debug.Stack())
+			r.notifyPanic(err)
+		}
+	}()
+
+	intervalTicker := time.NewTicker(r.interval)
+	defer intervalTicker.Stop()
+	pingTicker := time.NewTicker(time.Second * 5)
+	defer pingTicker.Stop()
 
-		case metrics.Timer:
-			ms := metric.Snapshot()
-			ps := ms.Percentiles([]float64{0.5, 0.75, 0.95, 0.99, 0.999, 0.9999})
-			fields := map[string]float64{
-				"count":    float64(ms.Count()),
-				"max":      float64(ms.Max()),
-				"mean":     ms.Mean(),
-				"min":      float64(ms.Min()),
-				"stddev":   ms.StdDev(),
-				"variance": ms.Variance(),
-				"p50":      ps[0],
-				"p75":      ps[1],
-				"p95":      ps[2],
-				"p99":      ps[3],
-				"p999":     ps[4],
-				"p9999":    ps[5],
-				"m1":       ms.Rate1(),
-				"m5":       ms.Rate5(),
-				"m15":      ms.Rate15(),
-				"meanrate": ms.RateMean(),
+	var (
+		lastSend time.Time
+		// pending fires for a flush postponed to honour the minimum interval.
+		pending <-chan time.Time
+	)
+	flush := func() {
+		if wait := r.minInterval - time.Since(lastSend); wait > 0 {
+			if pending == nil {
+				pending = time.After(wait)
+			} else {
+				// Coalesced into the pending flush.
+				atomic.AddInt64(&r.skippedTicks, 1)
 			}
-			for k, v := range fields {
-				p := client.NewPoint(r.measurement,
-					bucketTags(k, r.tags),
-					map[string]interface{}{
-						fmt.Sprintf("%s.timer", name): v,
-					},
-					now)
-				writeAPI.WritePoint(p)
+			return
+		}
+		pending = nil
+		if r.writer.busy() {
+			// Building points now would advance the per-metric caches for
+			// points which could not be written.
+			atomic.AddInt64(&r.skippedTicks, 1)
+			r.logf("previous write is still in progress, skipping flush")
+			return
+		}
+		lastSend = time.Now()
+		if !r.checked {
+			r.checked = true
+			r.checkDestination(r.baseCtx)
+		}
+		if err := r.send(); err != nil {
+			r.recordError(err)
+			r.checkAuth(err)
+			r.checkPartialWrite(err)
+			r.logFailure("unable to send metrics to InfluxDB", err)
+		} else if n := r.sendFailures.succeeded(); n > 0 {
+			r.logf("sent metrics to InfluxDB again after %d failures", n)
+		}
+		// The ticker drops the ticks which fired while the flush was running.
+		if missed := int64(time.Since(lastSend) / r.interval); missed > 0 {
+			atomic.AddInt64(&r.skippedTicks, missed)
+		}
+	}
+
+	if r.startupFlush {
+		// Only once, not again when the loop is restarted after a panic.
+		r.startupFlush = false
+		flush()
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			r.shutdown()
+			return true
+		case <-intervalTicker.C:
+			flush()
+		case <-r.flushRequests:
+			flush()
+		case <-pending:
+			pending = nil
+			flush()
+		case reason := <-r.reconnects:
+			r.reconnect(reason)
+		case <-pingTicker.C:
+			// The ping derives from the base context, like every request, and
+			// is bounded so that a hung server does not stall the interval
+			// flushes.
+			pingCtx, cancel := context.WithTimeout(r.baseCtx, r.readyTimeout)
+			err := r.Ping(pingCtx)
+			cancel()
+			if err != nil {
+				r.recordError(err)
+				r.logFailure("got error while sending a ping to InfluxDB, trying to recreate client", err)
+				r.reloadToken()
+				r.reconnect(fmt.Sprintf("ping failed: %v", err))
 			}
 		}
+	}
+}
+
+// logFailure logs a failure, throttled by the send error log throttle.
+func (r *Reporter) logFailure(msg string, err error) {
+	if n, ok := r.sendFailures.failed(time.Now()); ok && n > 1 {
+		r.logf("%s, %d consecutive failures. err=%v", msg, n, err)
+	} else if ok {
+		r.logf("%s. err=%v", msg, err)
+	}
+}
+
+// failureLog throttles the logging of consecutive failures, so that a long
+// outage does not flood the logs. Every failure is logged unless every or
+// period is set. It is safe for concurrent use, as the failures of the
+// asynchronous writes are reported by other goroutines.
+type failureLog struct {
+	// every logs every nth consecutive failure.
+	every int
+	// period logs a failure when the previous one was logged period ago.
+	period time.Duration
+
+	mu       sync.Mutex
+	failures int
+	logged   time.Time
+	// clean is set by a successful flush and cleared by a failure.
+	clean bool
+}
+
+// failed records a failure at now, returning the number of consecutive
+// failures and whether it should be logged.
+func (l *failureLog) failed(now time.Time) (int, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.clean = false
+	l.failures++
+	log := l.every <= 0 && l.period <= 0 ||
+		l.failures == 1 ||
+		l.every > 0 && l.failures%l.every == 0 ||
+		l.period > 0 && now.Sub(l.logged) >= l.period
+	if log {
+		l.logged = now
+	}
+	return l.failures, log
+}
+
+// succeeded records a successful flush, returning the number of consecutive
+// failures it ended when these were throttled, so that the recovery can be
+// logged. The failures of the asynchronous writes of the v2 client are only
+// reported after their flush, so the failures are ended by the second
+// successful flush in a row without a failure in between.
+func (l *failureLog) succeeded() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.clean {
+		l.clean = true
+		return 0
+	}
+	n := l.failures
+	l.failures = 0
+	if l.every <= 0 && l.period <= 0 {
+		return 0
+	}
+	return n
+}
+
+// Flush asks the reporting loop to flush as soon as possible and returns
+// without waiting for it. Requests made while one is already pending are
+// coalesced, and flushes are spaced by at least the WithMinInterval duration.
+func (r *Reporter) Flush() {
+	select {
+	case r.flushRequests <- struct{}{}:
+	default:
+	}
+}
+
+// shutdown performs a final flush, so that metrics updated since the last
+// interval are not lost, and closes the client, which flushes its buffers and
+// releases its connections. With a shutdown timeout, it gives up waiting for
+// both once the timeout passes, so that the process can exit.
+func (r *Reporter) shutdown() {
+	if r.shutdownTimeout <= 0 {
+		r.finalFlush()
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.finalFlush()
+	}()
+	select {
+	case <-done:
+	case <-time.After(r.shutdownTimeout):
+		r.logf("final flush did not complete within %v, giving up", r.shutdownTimeout)
+	}
+}
+
+func (r *Reporter) finalFlush() {
+	if err := r.send(); err != nil {
+		r.recordError(err)
+		r.logf("unable to send metrics to InfluxDB on shutdown. err=%v", err)
+	}
+	r.closeOnce.Do(func() {
+		if err := r.writer.close(); err != nil {
+			r.logf("unable to close the sink. err=%v", err)
+		}
 	})
-	writeAPI.Flush()
+}
+
+func (r *Reporter) send() (err error) {
+	start := time.Now()
+	if r.bucketProvider != nil {
+		org, bucket := r.bucketProvider()
+		r.mu.Lock()
+		r.org, r.bucket = org, bucket
+		r.mu.Unlock()
+	}
+	ctx, cancel := context.WithTimeout(r.baseCtx, r.writeTimeout)
+	defer cancel()
+	if r.sendContext != nil {
+		var finish func(error)
+		ctx, finish = r.sendContext(ctx)
+		if finish != nil {
+			defer func() { finish(err) }()
+		}
+	}
+
+	b := r.points(r.timestamp(), true)
+	if r.preWrite != nil {
+		b.points = r.preWrite(b.points)
+		if len(b.points) == 0 && len(b.routed) == 0 && len(b.records) == 0 {
+			return nil
+		}
+	}
+	r.writeDebug(b)
+	n, err := r.writeBatch(ctx, b)
+	if r.scrapeMeasurement != "" {
+		r.writeScrapeStatus(ctx, b.now, time.Since(start), err == nil)
+	}
+	if err != nil {
+		return err
+	}
+	if b.info {
+		r.pointsMu.Lock()
+		r.infoWritten = true
+		r.pointsMu.Unlock()
+	}
+	r.notifyWrite(n, time.Since(start))
 	return nil
 }
 
-func bucketTags(bucket string, tags map[string]string) map[string]string {
-	m := map[string]string{}
-	for tk, tv := range tags {
-		m[tk] = tv
+// writeBatch writes the points of b to their buckets, returning how many.
+func (r *Reporter) writeBatch(ctx context.Context, b *batch) (int, error) {
+	if err := r.writeRetrying(ctx, r.org, r.bucket, b.points); err != nil {
+		return 0, err
+	}
+	n := len(b.points)
+	for bucket, points := range b.routed {
+		if err := r.writeRetrying(ctx, r.org, bucket, points); err != nil {
+			return n, err
+		}
+		n += len(points)
+	}
+	if len(b.records) > 0 {
+		if err := r.writer.writeRecords(ctx, r.org, r.bucket, b.records); err != nil {
+			return n, fmt.Errorf("unable to forward records: %w", err)
+		}
+		n += len(b.records)
+	}
+	return n, nil
+}
+
+// writeScrapeStatus writes the duration and the success of a flush, like the
+// scrape_duration_seconds and up series of Prometheus. Its own errors are
+// only logged.
+func (r *Reporter) writeScrapeStatus(ctx context.Context, ts time.Time, took time.Duration, ok bool) {
+	if r.writer.busy() {
+		return
+	}
+	success := 0
+	if ok {
+		success = 1
 	}
-	m["bucket"] = bucket
-	return m
+	tags := r.internalTags()
+	points := []*write.Point{
+		r.newPoint(r.scrapeMeasurement, tags, map[string]interface{}{"scrape_duration_seconds": took.Seconds()}, ts),
+		r.newPoint(r.scrapeMeasurement, tags, map[string]interface{}{"scrape_success": success}, ts),
+	}
+	if err := r.writer.writePoints(ctx, r.org, r.bucket, points); err != nil {
+		r.logf("unable to write the flush status to InfluxDB. err=%v", err)
+	}
+}
+
+// notifyPanic invokes the panic handler, shielding the restart of the
+// reporting loop from its panics.
+func (r *Reporter) notifyPanic(err interface{}) {
+	if r.panicHandler == nil {
+		return
+	}
+	defer func() {
+		if err := recover(); err != nil {
+			r.logf("panic handler panicked. err=%v", err)
+		}
+	}()
+	r.panicHandler(err)
+}
+
+// notifyWrite invokes the write callback, shielding the reporting loop from its panics.
+func (r *Reporter) notifyWrite(points int, took time.Duration) {
+	if r.writeCallback == nil {
+		return
+	}
+	defer func() {
+		if err := recover(); err != nil {
+			r.logf("write callback panicked. err=%v", err)
+		}
+	}()
+	r.writeCallback(points, took)
 }
@@ -0,0 +1,246 @@
+package influxdb
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	client "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"github.com/rcrowley/go-metrics"
+)
+
+// recordingClient counts the points written through a client and its
+// closings.
+type recordingClient struct {
+	client.Client
+	mu     sync.Mutex
+	points int
+	closed int
+	// pointsAtClose is the number of points written when it was closed.
+	pointsAtClose int
+	// closedc receives a value at every closing.
+	closedc chan struct{}
+}
+
+func newRecordingClient(c client.Client) *recordingClient {
+	return &recordingClient{Client: c, closedc: make(chan struct{}, 2)}
+}
+
+func (c *recordingClient) WriteAPI(org, bucket string) api.WriteAPI {
+	return recordingWriteAPI{WriteAPI: c.Client.WriteAPI(org, bucket), c: c}
+}
+
+func (c *recordingClient) Close() {
+	c.mu.Lock()
+	c.closed++
+	c.pointsAtClose = c.points
+	c.mu.Unlock()
+	c.Client.Close()
+	c.closedc <- struct{}{}
+}
+
+type recordingWriteAPI struct {
+	api.WriteAPI
+	c *recordingClient
+}
+
+func (w recordingWriteAPI) WritePoint(p *write.Point) {
+	w.c.mu.Lock()
+	w.c.points++
+	w.c.mu.Unlock()
+	w.WriteAPI.WritePoint(p)
+}
+
+// newTestReporter returns a reporter of reg. The tests never reach the server.
+func newTestReporter(t testing.TB, reg Registry, interval time.Duration, opts ...Option) *Reporter {
+	t.Helper()
+	r, err := New(reg, interval, "http://localhost:8086", "bucket", "measurement", "org", "token", opts...)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return r
+}
+
+// fieldValue returns the value of the field key of the point of points
+// carrying the given bucket tag, "" for points without one.
+func fieldValue(points []*write.Point, key, bucket string) (interface{}, bool) {
+	for _, p := range points {
+		var b string
+		for _, t := range p.TagList() {
+			if t.Key == "bucket" {
+				b = t.Value
+			}
+		}
+		if b != bucket {
+			continue
+		}
+		for _, f := range p.FieldList() {
+			if f.Key == key {
+				return f.Value, true
+			}
+		}
+	}
+	return nil, false
+}
+
+func TestStartTwice(t *testing.T) {
+	// Every flush reads the gauge, which blocks until the test releases it.
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	reg := metrics.NewRegistry()
+	reg.Register("flushes", metrics.NewFunctionalGauge(func() int64 {
+		select {
+		case entered <- struct{}{}:
+			<-release
+		case <-release:
+		}
+		return 1
+	}))
+	interval := 10 * time.Millisecond
+	r := newTestReporter(t, reg, interval)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer close(release)
+	if err := r.Start(ctx); err != nil {
+		t.Fatalf("first Start: %v", err)
+	}
+	if err := r.Start(ctx); err != ErrAlreadyStarted {
+		t.Fatalf("second Start = %v, want ErrAlreadyStarted", err)
+	}
+	if err := r.Run(ctx); err != ErrAlreadyStarted {
+		t.Fatalf("Run = %v, want ErrAlreadyStarted", err)
+	}
+
+	select {
+	case <-entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the reporter did not flush")
+	}
+	// The first loop is held in its flush: a second loop would flush meanwhile.
+	select {
+	case <-entered:
+		t.Fatal("a second reporting loop is flushing")
+	case <-time.After(10 * interval):
+	}
+}
+
+func TestShutdownClosesClient(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		stop func(r *Reporter, cancel context.CancelFunc)
+	}{
+		{"Stop", func(r *Reporter, cancel context.CancelFunc) { r.Stop() }},
+		{"context", func(r *Reporter, cancel context.CancelFunc) { cancel() }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			reg := metrics.NewRegistry()
+			metrics.GetOrRegisterCounter("requests", reg).Inc(1)
+			r := newTestReporter(t, reg, time.Hour)
+			c := newRecordingClient(r.client)
+			r.client = c
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if err := r.Start(ctx); err != nil {
+				t.Fatalf("Start: %v", err)
+			}
+			tc.stop(r, cancel)
+			select {
+			case <-c.closedc:
+			case <-time.After(5 * time.Second):
+				t.Fatal("the client was not closed")
+			}
+			// Stopping again must not close the client again.
+			r.Stop()
+
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if c.closed != 1 {
+				t.Errorf("client closed %d times, want 1", c.closed)
+			}
+			if c.points != 1 || c.pointsAtClose != 1 {
+				t.Errorf("got %d points, %d before Close, want the final flush before Close",
+					c.points, c.pointsAtClose)
+			}
+		})
+	}
+}
+
+// eachRegistry is a registry implementing only Each.
+type eachRegistry map[string]interface{}
+
+func (r eachRegistry) Each(fn func(name string, metric interface{})) {
+	for name, metric := range r {
+		fn(name, metric)
+	}
+}
+
+func TestEachOnlyRegistry(t *testing.T) {
+	counter := metrics.NewCounter()
+	counter.Inc(3)
+	gauge := metrics.NewGauge()
+	gauge.Update(7)
+	r := newTestReporter(t, eachRegistry{"requests": counter}, time.Minute,
+		WithRegistry(eachRegistry{"queue": gauge}, "extra.", nil))
+
+	b := r.points(time.Now(), false)
+	if v, ok := fieldValue(b.points, "requests.count", ""); !ok || v != int64(3) {
+		t.Errorf("requests.count = %v, %v, want 3", v, ok)
+	}
+	if v, ok := fieldValue(b.points, "extra.queue.gauge", ""); !ok || v != int64(7) {
+		t.Errorf("extra.queue.gauge = %v, %v, want 7", v, ok)
+	}
+}
+
+func TestPanicHandlerPanics(t *testing.T) {
+	flushes := make(chan int, 10)
+	var n int
+	reg := metrics.NewRegistry()
+	metrics.GetOrRegisterCounter("requests", reg).Inc(1)
+	r := newTestReporter(t, reg, 10*time.Millisecond,
+		WithPreWriteHook(func(points []*write.Point) []*write.Point {
+			n++
+			flushes <- n
+			if n == 1 {
+				panic("pre-write hook")
+			}
+			return points
+		}),
+		WithPanicHandler(func(interface{}) { panic("panic handler") }))
+
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer r.Stop()
+	for want := 1; want <= 2; want++ {
+		select {
+		case got := <-flushes:
+			if got != want {
+				t.Fatalf("flush %d, want %d", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("flush %d did not happen, the loop was not restarted", want)
+		}
+	}
+}
+
+func TestSkippedTicksGaugeRegisteredByNew(t *testing.T) {
+	reg := metrics.NewRegistry()
+	_, err := New(reg, time.Minute, "http://localhost:8086", "bucket", "measurement", "org", "token",
+		WithSkippedTicksGauge(reg, "skipped_ticks"), WithCounterNameTags("("))
+	if err == nil {
+		t.Fatal("New succeeded with an invalid pattern")
+	}
+	if reg.Get("skipped_ticks") != nil {
+		t.Error("the gauge of a reporter which failed to be created was registered")
+	}
+
+	newTestReporter(t, reg, time.Minute, WithSkippedTicksGauge(reg, "skipped_ticks"))
+	if _, ok := reg.Get("skipped_ticks").(metrics.Gauge); !ok {
+		t.Error("the skipped ticks gauge was not registered")
+	}
+}
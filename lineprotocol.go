@@ -0,0 +1,175 @@
+package influxdb
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+var (
+	measurementEscaper = strings.NewReplacer(`,`, `\,`, ` `, `\ `)
+	keyEscaper         = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `)
+	stringEscaper      = strings.NewReplacer(`"`, `\"`, `\`, `\\`)
+)
+
+// encodeLineProtocol encodes a point as a line of line protocol with a
+// nanosecond timestamp, without the trailing newline. Tags and fields are
+// sorted by key so that the output is deterministic. Fields of unsupported
+// types are skipped.
+func encodeLineProtocol(measurement string, tags map[string]string, fields map[string]interface{}, t time.Time) string {
+	var sb strings.Builder
+	sb.WriteString(measurementEscaper.Replace(measurement))
+
+	for _, k := range sortedKeys(tags) {
+		if tags[k] == "" {
+			continue
+		}
+		sb.WriteByte(',')
+		sb.WriteString(keyEscaper.Replace(k))
+		sb.WriteByte('=')
+		sb.WriteString(keyEscaper.Replace(tags[k]))
+	}
+
+	sep := byte(' ')
+	for _, k := range sortedFieldKeys(fields) {
+		v, ok := encodeFieldValue(fields[k])
+		if !ok {
+			continue
+		}
+		sb.WriteByte(sep)
+		sep = ','
+		sb.WriteString(keyEscaper.Replace(k))
+		sb.WriteByte('=')
+		sb.WriteString(v)
+	}
+
+	sb.WriteByte(' ')
+	sb.WriteString(strconv.FormatInt(t.UnixNano(), 10))
+	return sb.String()
+}
+
+// encodeFieldValue encodes a field value, reporting false for unsupported
+// types.
+func encodeFieldValue(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), true
+	case float32:
+		return strconv.FormatFloat(float64(v), 'g', -1, 32), true
+	case int64:
+		return strconv.FormatInt(v, 10) + "i", true
+	case int:
+		return strconv.FormatInt(int64(v), 10) + "i", true
+	case int32:
+		return strconv.FormatInt(int64(v), 10) + "i", true
+	case uint64:
+		return strconv.FormatUint(v, 10) + "u", true
+	case uint:
+		return strconv.FormatUint(uint64(v), 10) + "u", true
+	case bool:
+		return strconv.FormatBool(v), true
+	case string:
+		return `"` + stringEscaper.Replace(v) + `"`, true
+	}
+	return "", false
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedFieldKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// pointLine encodes p with encodeLineProtocol.
+func pointLine(p *write.Point) string {
+	tags := make(map[string]string, len(p.TagList()))
+	for _, t := range p.TagList() {
+		tags[t.Key] = t.Value
+	}
+	fields := make(map[string]interface{}, len(p.FieldList()))
+	for _, f := range p.FieldList() {
+		fields[f.Key] = f.Value
+	}
+	return encodeLineProtocol(p.Name(), tags, fields, p.Time())
+}
+
+// jsonPoint is the JSON representation of a point written by the JSON debug
+// writer.
+type jsonPoint struct {
+	Measurement string                 `json:"measurement"`
+	Tags        map[string]string      `json:"tags"`
+	Fields      map[string]interface{} `json:"fields"`
+	Time        time.Time              `json:"time"`
+}
+
+// pointJSON encodes p as a line of JSON.
+func pointJSON(p *write.Point) (string, error) {
+	jp := jsonPoint{
+		Measurement: p.Name(),
+		Tags:        make(map[string]string, len(p.TagList())),
+		Fields:      make(map[string]interface{}, len(p.FieldList())),
+		Time:        p.Time(),
+	}
+	for _, t := range p.TagList() {
+		jp.Tags[t.Key] = t.Value
+	}
+	for _, f := range p.FieldList() {
+		jp.Fields[f.Key] = f.Value
+	}
+	line, err := json.Marshal(jp)
+	return string(line), err
+}
+
+// writeDebug writes the points of a flush to the debug writers, one line of
+// line protocol or JSON each.
+func (r *Reporter) writeDebug(b *batch) {
+	if r.debugWriter == nil && r.jsonDebugWriter == nil {
+		return
+	}
+	points := b.points
+	for _, routed := range b.routed {
+		points = append(points, routed...)
+	}
+	if r.debugWriter != nil {
+		var sb strings.Builder
+		for _, p := range points {
+			sb.WriteString(pointLine(p))
+			sb.WriteByte('\n')
+		}
+		if _, err := io.WriteString(r.debugWriter, sb.String()); err != nil {
+			r.logf("unable to write metrics to the debug writer. err=%v", err)
+		}
+	}
+	if r.jsonDebugWriter != nil {
+		var sb strings.Builder
+		for _, p := range points {
+			line, err := pointJSON(p)
+			if err != nil {
+				r.logf("unable to encode a point as JSON. err=%v", err)
+				continue
+			}
+			sb.WriteString(line)
+			sb.WriteByte('\n')
+		}
+		if _, err := io.WriteString(r.jsonDebugWriter, sb.String()); err != nil {
+			r.logf("unable to write metrics to the JSON debug writer. err=%v", err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package influxdb
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEncodeLineProtocol(t *testing.T) {
+	ts := time.Unix(1, 5)
+	for _, tc := range []struct {
+		name        string
+		measurement string
+		tags        map[string]string
+		fields      map[string]interface{}
+		want        string
+	}{
+		{
+			name:        "escaped measurement",
+			measurement: "go metrics,v2",
+			fields:      map[string]interface{}{"value": 1.5},
+			want:        `go\ metrics\,v2 value=1.5 1000000005`,
+		},
+		{
+			name:        "escaped tags",
+			measurement: "m",
+			tags:        map[string]string{"a key": "x,y=z"},
+			fields:      map[string]interface{}{"value": 1.5},
+			want:        `m,a\ key=x\,y\=z value=1.5 1000000005`,
+		},
+		{
+			name:        "escaped field key",
+			measurement: "m",
+			fields:      map[string]interface{}{"a,b=c d": 1.5},
+			want:        `m a\,b\=c\ d=1.5 1000000005`,
+		},
+		{
+			name:        "escaped string value",
+			measurement: "m",
+			fields:      map[string]interface{}{"msg": `say "hi" \o/`},
+			want:        `m msg="say \"hi\" \\o/" 1000000005`,
+		},
+		{
+			name:        "sorted tags and fields",
+			measurement: "m",
+			tags:        map[string]string{"host": "a", "bucket": "p99", "env": "prod"},
+			fields:      map[string]interface{}{"z": 1.0, "a": 2.0, "m": 3.0},
+			want:        `m,bucket=p99,env=prod,host=a a=2,m=3,z=1 1000000005`,
+		},
+		{
+			name:        "integers",
+			measurement: "m",
+			fields:      map[string]interface{}{"a": int64(-3), "b": 4, "c": int32(5)},
+			want:        `m a=-3i,b=4i,c=5i 1000000005`,
+		},
+		{
+			name:        "unsigned integers",
+			measurement: "m",
+			fields:      map[string]interface{}{"a": uint64(3), "b": uint(4)},
+			want:        `m a=3u,b=4u 1000000005`,
+		},
+		{
+			name:        "booleans",
+			measurement: "m",
+			fields:      map[string]interface{}{"down": false, "up": true},
+			want:        `m down=false,up=true 1000000005`,
+		},
+		{
+			name:        "floats",
+			measurement: "m",
+			fields:      map[string]interface{}{"a": 0.25, "b": float32(1.5), "c": 1e21, "d": 3.0},
+			want:        `m a=0.25,b=1.5,c=1e+21,d=3 1000000005`,
+		},
+		{
+			name:        "unsupported types skipped",
+			measurement: "m",
+			fields:      map[string]interface{}{"a": []int{1}, "b": 1.5, "c": struct{}{}},
+			want:        `m b=1.5 1000000005`,
+		},
+		{
+			name:        "empty tag values skipped",
+			measurement: "m",
+			tags:        map[string]string{"bucket": "", "host": "a"},
+			fields:      map[string]interface{}{"value": 1.5},
+			want:        `m,host=a value=1.5 1000000005`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := encodeLineProtocol(tc.measurement, tc.tags, tc.fields, ts); got != tc.want {
+				t.Errorf("got  %s\nwant %s", got, tc.want)
+			}
+		})
+	}
+}
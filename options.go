@@ -0,0 +1,1115 @@
+package influxdb
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"math/rand"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"github.com/rcrowley/go-metrics"
+)
+
+// Option configures optional reporter behaviour.
+type Option func(*Reporter)
+
+// WithTags sets the tags attached to every point.
+func WithTags(tags map[string]string) Option {
+	return func(r *Reporter) {
+		r.tags = tags
+	}
+}
+
+// WithAlign truncates the timestamp of every point down to the nearest even
+// integral of the reporting interval.
+func WithAlign() Option {
+	return func(r *Reporter) {
+		r.align = true
+	}
+}
+
+// AlignMode selects the reference timestamps are aligned to.
+type AlignMode int
+
+const (
+	// AlignEpoch truncates timestamps relative to the Unix epoch. Intervals
+	// which do not evenly divide a minute or an hour (e.g. 45s) produce
+	// boundaries drifting relative to wall-clock minutes.
+	AlignEpoch AlignMode = iota
+	// AlignWallClock truncates timestamps relative to the local midnight, so
+	// boundaries stay on the same wall-clock minutes and hours every day for
+	// any interval dividing a day, also in time zones with a non-hour offset.
+	AlignWallClock
+)
+
+// WithSecondPrecision truncates the timestamps of the points to the second
+// and writes them with a second precision, like StatsD and Graphite
+// pipelines, without aligning them to the interval as WithAlign does. The
+// timestamps made unique across flushes, e.g. those of deltas, are then
+// moved forward by a second rather than a nanosecond.
+func WithSecondPrecision() Option {
+	return func(r *Reporter) {
+		r.seconds = true
+	}
+}
+
+// WithExportTimestamp adds the time of the flush, in epoch milliseconds, to
+// the points of the metrics as the integer field field, e.g. to measure the
+// ingest lag against the time InfluxDB receives them. It holds the actual
+// time of the flush even when the timestamps of the points are aligned or
+// truncated. The points given to Enqueue and the info point do not get it.
+func WithExportTimestamp(field string) Option {
+	return func(r *Reporter) {
+		r.exportField = field
+	}
+}
+
+// WithDisableAlignForCounters timestamps the points of counters, and the
+// delta points of WithCounterDeltas and WithMeterCountDeltas, with the
+// unaligned time of the flush while the other points stay aligned, so that
+// deltas of consecutive flushes never share a truncated timestamp.
+func WithDisableAlignForCounters() Option {
+	return func(r *Reporter) {
+		r.unalignedCounters = true
+	}
+}
+
+// WithAlignMode enables timestamp alignment using the given mode. WithAlign
+// uses AlignEpoch.
+func WithAlignMode(mode AlignMode) Option {
+	return func(r *Reporter) {
+		r.align = true
+		r.alignMode = mode
+	}
+}
+
+// AlignCollision selects how gauges are reported by flushes sharing an
+// aligned timestamp, e.g. extra flushes or flushes more frequent than the
+// alignment, whose points would otherwise overwrite each other in InfluxDB.
+type AlignCollision int
+
+const (
+	// AlignCollisionLast writes the value of every flush, InfluxDB keeping
+	// the last one. This is the default.
+	AlignCollisionLast AlignCollision = iota
+	// AlignCollisionOffset moves the timestamp of the gauge points of every
+	// flush forward by the nanoseconds (seconds with WithSecondPrecision)
+	// needed to be later than those of the previous flush, keeping every
+	// value.
+	AlignCollisionOffset
+	// AlignCollisionMax writes the maximum of the values reported at the
+	// aligned timestamp.
+	AlignCollisionMax
+	// AlignCollisionMean writes the mean of the values reported at the
+	// aligned timestamp, rounded to the nearest integer for integer gauges.
+	AlignCollisionMean
+)
+
+// WithAlignCollision selects how gauges are reported by flushes sharing an
+// aligned timestamp. It has no effect without alignment, nor on the delta
+// points of WithGaugeDeltas which always get unique timestamps.
+func WithAlignCollision(c AlignCollision) Option {
+	return func(r *Reporter) {
+		r.alignCollision = c
+	}
+}
+
+// WithMeterIntervalRate enables the <name>.rate_interval field for meters,
+// holding the rate computed since the previous flush only (count delta /
+// elapsed time), alongside the EWMA-based m1/m5/m15 rates.
+func WithMeterIntervalRate() Option {
+	return func(r *Reporter) {
+		r.meterRates = newCountCache()
+		r.meterRateTimes = newCountCache()
+	}
+}
+
+// MetricType identifies a kind of go-metrics metric.
+type MetricType int
+
+// Metric types understood by the reporter.
+const (
+	Counter MetricType = iota
+	Gauge
+	GaugeFloat64
+	Histogram
+	Meter
+	Timer
+	Healthcheck
+)
+
+// metricTypeOf returns the MetricType of a registry entry.
+func metricTypeOf(i interface{}) (MetricType, bool) {
+	switch i.(type) {
+	case metrics.Counter:
+		return Counter, true
+	case metrics.Gauge:
+		return Gauge, true
+	case metrics.GaugeFloat64:
+		return GaugeFloat64, true
+	case metrics.Histogram:
+		return Histogram, true
+	case metrics.Meter:
+		return Meter, true
+	case metrics.Timer:
+		return Timer, true
+	case metrics.Healthcheck:
+		return Healthcheck, true
+	}
+	return 0, false
+}
+
+// WithEnabledTypes reports only metrics of the given types, all other types
+// are skipped. By default every type is reported. Repeated calls extend the
+// enabled types.
+func WithEnabledTypes(types ...MetricType) Option {
+	return func(r *Reporter) {
+		if r.enabledTypes == nil {
+			r.enabledTypes = map[MetricType]bool{}
+		}
+		for _, t := range types {
+			r.enabledTypes[t] = true
+		}
+	}
+}
+
+// WithDisabledTypes skips every metric of the given types. It takes
+// precedence over WithEnabledTypes, whatever the order of the options.
+func WithDisabledTypes(types ...MetricType) Option {
+	return func(r *Reporter) {
+		if r.disabledTypes == nil {
+			r.disabledTypes = map[MetricType]bool{}
+		}
+		for _, t := range types {
+			r.disabledTypes[t] = true
+		}
+	}
+}
+
+// WithMetricAllowlist only reports the metrics with the given names, as
+// reported, i.e. prefixed and rewritten. The metrics must also pass the other
+// filters, e.g. be of an enabled type. Repeated calls extend the list.
+func WithMetricAllowlist(names ...string) Option {
+	return func(r *Reporter) {
+		if r.allowlist == nil {
+			r.allowlist = map[string]bool{}
+		}
+		for _, name := range names {
+			r.allowlist[name] = true
+		}
+	}
+}
+
+// WithBucketForTypes writes the points of the given metric types to bucket
+// instead of the reporter's bucket, e.g. to keep histograms, meters and
+// timers for a shorter retention than counters and gauges.
+func WithBucketForTypes(bucket string, types ...MetricType) Option {
+	return func(r *Reporter) {
+		if r.typeBuckets == nil {
+			r.typeBuckets = map[MetricType]string{}
+		}
+		for _, t := range types {
+			r.typeBuckets[t] = bucket
+		}
+	}
+}
+
+// WithWriteTimeout bounds how long a flush may block on a full write buffer.
+// Points which could not be handed over to the client within d are dropped
+// and counted in DroppedPoints. A short timeout favours dropping, a long one
+// applies back-pressure. Defaults to the reporting interval.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(r *Reporter) {
+		r.writeTimeout = d
+	}
+}
+
+// WithWriteDeadlineFromInterval sets the write timeout to the given fraction
+// of the reporting interval, e.g. 0.8, so that it follows changes of the
+// interval. It takes precedence over WithWriteTimeout.
+func WithWriteDeadlineFromInterval(fraction float64) Option {
+	return func(r *Reporter) {
+		r.writeTimeoutFraction = fraction
+	}
+}
+
+// WithReadyTimeout bounds the periodic ping checking that InfluxDB is ready,
+// so that a hung server does not stall the reporting loop. Defaults to 3
+// seconds.
+func WithReadyTimeout(d time.Duration) Option {
+	return func(r *Reporter) {
+		r.readyTimeout = d
+	}
+}
+
+// WithSkipIdleDistributions omits the distribution fields (percentiles, min,
+// max, mean, ...) of histograms and timers whose count did not increase since
+// the previous flush. The count is still reported so gaps remain visible.
+func WithSkipIdleDistributions() Option {
+	return func(r *Reporter) {
+		r.idleCounts = newCountCache()
+	}
+}
+
+// WithWriteCallback registers fn to be called after every successful flush
+// with the number of points written and the time the flush took. It is not
+// called for failed flushes; a panic in fn is recovered and logged. With the
+// InfluxDB v2 client, the points are then written synchronously (see
+// v2Writer).
+func WithWriteCallback(fn func(points int, took time.Duration)) Option {
+	return func(r *Reporter) {
+		r.writeCallback = fn
+	}
+}
+
+// WithBucketProvider makes the reporter call fn at the start of every flush
+// to resolve the org and bucket to write to, allowing the destination to
+// change without a restart.
+func WithBucketProvider(fn func() (org, bucket string)) Option {
+	return func(r *Reporter) {
+		r.bucketProvider = fn
+	}
+}
+
+// WithHeartbeat writes a point with field set to 1 every interval, whatever
+// the contents of the registry, so that a gap clearly shows the reporter
+// stopped running.
+func WithHeartbeat(field string) Option {
+	return func(r *Reporter) {
+		r.heartbeat = field
+	}
+}
+
+// WithName prefixes every log line of the reporter with [name], which keeps
+// the output of several reporters apart.
+func WithName(name string) Option {
+	return func(r *Reporter) {
+		r.name = name
+	}
+}
+
+// WithErrorHandler sets the function receiving the errors of asynchronous
+// writes, which are logged by default. fn is called from a separate
+// goroutine. It has no effect together with WithSkipErrorsChannel.
+func WithErrorHandler(fn func(error)) Option {
+	return func(r *Reporter) {
+		r.errorHandler = fn
+	}
+}
+
+// WithSkipErrorsChannel stops the reporter from subscribing to the errors
+// channel of its write APIs, for users consuming it themselves. Write errors
+// are then neither logged nor passed to the WithErrorHandler function.
+func WithSkipErrorsChannel() Option {
+	return func(r *Reporter) {
+		r.skipErrors = true
+	}
+}
+
+// WithInfoPoint writes a single point with the field info=1 and the given
+// tags (e.g. version and commit) with the first successful flush, which
+// allows tracking the binary versions that are live. A go_version tag is added
+// unless tags already holds one.
+func WithInfoPoint(tags map[string]string) Option {
+	return func(r *Reporter) {
+		r.infoTags = tags
+		if r.infoTags == nil {
+			r.infoTags = map[string]string{}
+		}
+	}
+}
+
+// WithInfoMeasurement sets the measurement of the WithInfoPoint point, which
+// defaults to the reporter measurement.
+func WithInfoMeasurement(measurement string) Option {
+	return func(r *Reporter) {
+		r.infoMeasurement = measurement
+	}
+}
+
+// registry is a registry reported in addition to the main one.
+type registry struct {
+	reg    Registry
+	prefix string
+	tags   map[string]string
+}
+
+// WithRegistry reports the metrics of reg in the same flushes as the main
+// registry. The names of its metrics are prefixed with prefix and its points
+// carry tags in addition to the reporter tags, either of which can be used to
+// tell apart metrics registered under the same name in several registries.
+func WithRegistry(reg Registry, prefix string, tags map[string]string) Option {
+	return func(r *Reporter) {
+		r.registries = append(r.registries, registry{reg: reg, prefix: prefix, tags: tags})
+	}
+}
+
+// WithMetricNameRewriter transforms the name of every metric with fn (e.g.
+// to replace separators or strip a prefix) before anything is derived from
+// it, so the result is used consistently throughout the points of the metric.
+func WithMetricNameRewriter(fn func(string) string) Option {
+	return func(r *Reporter) {
+		r.nameRewriter = fn
+	}
+}
+
+// WithStripPrefix removes prefix (e.g. "myapp.") from the name of every
+// metric, before the name rewriter and anything derived from the name. Names
+// without the prefix are left untouched.
+func WithStripPrefix(prefix string) Option {
+	return func(r *Reporter) {
+		r.stripPrefix = prefix
+	}
+}
+
+// WithTimestampFunc lets fn override the timestamp of the points of a metric,
+// e.g. for a gauge holding the time of the last event. When fn returns false
+// the flush time is used.
+func WithTimestampFunc(fn func(name string, metric interface{}) (time.Time, bool)) Option {
+	return func(r *Reporter) {
+		r.timestampFunc = fn
+	}
+}
+
+// WithMetricTimeout evaluates each functional gauge (metrics.FunctionalGauge
+// and metrics.FunctionalGaugeFloat64, backed by a user function) in a
+// goroutine bounded by d, so that a slow or hanging function does not stall
+// the flush. The gauges exceeding d are skipped and reported to the metric
+// error handler. Other metrics are not affected.
+func WithMetricTimeout(d time.Duration) Option {
+	return func(r *Reporter) {
+		r.metricTimeout = d
+	}
+}
+
+// WithMetricErrorHandler sets the function told about metrics whose points
+// could not be built, because building them panicked or produced a value
+// which cannot be written (NaN or infinite). The points of such a metric are
+// skipped while the rest of the flush proceeds. Errors are logged by default.
+func WithMetricErrorHandler(fn func(name string, err error)) Option {
+	return func(r *Reporter) {
+		r.metricErrorHandler = fn
+	}
+}
+
+// WithV3 writes to the given database of InfluxDB 3 instead of a bucket of
+// InfluxDB 2 or 1.8+, using the InfluxDB 3 write endpoint. The token is sent
+// as a bearer token and the org is ignored.
+func WithV3(database string) Option {
+	return func(r *Reporter) {
+		r.v3 = true
+		r.bucket = database
+	}
+}
+
+// WithPreWriteHook calls fn once per flush with the points about to be
+// written to the reporter's bucket, e.g. to dedupe them, cap their number or
+// add a tag to all of them. The points returned by fn are written instead, no
+// points skipping the write. The points routed to other buckets by
+// WithBucketForTypes are not passed to fn.
+func WithPreWriteHook(fn func([]*write.Point) []*write.Point) Option {
+	return func(r *Reporter) {
+		r.preWrite = fn
+	}
+}
+
+// WithSendContext calls fn at the start of every flush with the context of
+// its writes, e.g. to start a tracing span. The context returned by fn is used
+// for the writes of the flush and finish, if not nil, is called with the
+// error of the flush once it is done.
+func WithSendContext(fn func(ctx context.Context) (context.Context, func(error))) Option {
+	return func(r *Reporter) {
+		r.sendContext = fn
+	}
+}
+
+// WithMinInterval spaces flushes by at least d. Flushes requested sooner,
+// by Flush or by the interval ticker, are postponed and coalesced so that at
+// most one is pending.
+func WithMinInterval(d time.Duration) Option {
+	return func(r *Reporter) {
+		r.minInterval = d
+	}
+}
+
+// WithContext sets the base context from which the context of every write
+// and check made by the reporter is derived, e.g. to carry tracing spans or
+// request-scoped values. It does not govern the lifetime of the reporter,
+// which is controlled by the context given to Start or Run. Canceling it
+// makes writes fail without stopping the reporting loop. Defaults to
+// context.Background().
+func WithContext(ctx context.Context) Option {
+	return func(r *Reporter) {
+		r.baseCtx = ctx
+	}
+}
+
+// FieldType is the type a field value is written as.
+type FieldType int
+
+const (
+	// FieldDefault writes values with the type produced by go-metrics.
+	FieldDefault FieldType = iota
+	// FieldInt writes values as integers.
+	FieldInt
+	// FieldFloat writes values as floats.
+	FieldFloat
+	// FieldBool writes values as booleans, true when not zero.
+	FieldBool
+	// FieldString writes values as strings.
+	FieldString
+)
+
+// WithGaugeFieldType writes the values of both Gauge and GaugeFloat64 as the
+// given type. By default Gauge values are integers and GaugeFloat64 values
+// floats, even when whole. InfluxDB fixes the type of a field on its first
+// write to a shard, so a field key written by both kinds of gauges needs a
+// consistent type: FieldFloat is lossless for all but huge integers, while
+// FieldInt truncates the fractional part of float gauges.
+func WithGaugeFieldType(t FieldType) Option {
+	return func(r *Reporter) {
+		r.gaugeFieldType = t
+	}
+}
+
+// WithPanicHandler sets a function called with the value of any panic
+// recovered from the reporting loop, e.g. raised by a hook or a client bug.
+// The loop is restarted after such a panic rather than silently exiting.
+func WithPanicHandler(fn func(interface{})) Option {
+	return func(r *Reporter) {
+		r.panicHandler = fn
+	}
+}
+
+// WithOptInTags makes the global tags with the given keys opt-in: they are
+// only attached to the points of the metrics for which allow returns true,
+// which keeps high-cardinality tags off the metrics that do not need them.
+func WithOptInTags(allow func(metric, tag string) bool, keys ...string) Option {
+	return func(r *Reporter) {
+		r.optInTags = keys
+		r.optInAllow = allow
+	}
+}
+
+// WithIntegerCounters selects whether counters are written as integer fields,
+// the default, or as float fields when integer is false. Floats avoid field
+// type conflicts in schemas where every numeric field must be a float.
+func WithIntegerCounters(integer bool) Option {
+	return func(r *Reporter) {
+		r.floatCounters = !integer
+	}
+}
+
+// WithStatsMeasurement writes the per-statistic points of histograms, meters
+// and timers, which carry the statistic in their bucket tag, to their own
+// measurement so they can be stored and retained independently from the
+// counter and gauge points.
+func WithStatsMeasurement(measurement string) Option {
+	return func(r *Reporter) {
+		r.statsMeasurementName = measurement
+	}
+}
+
+// WithTokenFile reads the InfluxDB token from the file at path, e.g. a
+// mounted Kubernetes secret, instead of taking it as an argument where it
+// would show in the process arguments. The file is read by New, which fails
+// if it cannot be read, and read again whenever the client is recreated after
+// a failed ping or InfluxDB rejects the token (401/403), so that a rotated
+// token is picked up.
+func WithTokenFile(path string) Option {
+	return func(r *Reporter) {
+		r.tokenFile = path
+	}
+}
+
+// WithCounterDeltas reports the increase of counters since the previous flush
+// instead of their cumulative count. The delta points of each flush get a
+// timestamp later than those of the previous flush, even when alignment
+// would give both flushes the same timestamp, so that consecutive deltas
+// never overwrite each other in InfluxDB.
+func WithCounterDeltas() Option {
+	return func(r *Reporter) {
+		r.counterDeltas = newCountCache()
+	}
+}
+
+// WithCounterNameTags extracts the measurement and tags of the counters whose
+// name matches pattern, a regular expression whose named groups give them:
+// the measurement group the measurement and the others tags of the same name.
+// The count is then written to the count field (see WithCounterField). E.g.
+// `^(?P<measurement>errors)\.(?P<code>\d+)$` writes errors.500 and errors.404
+// to the errors measurement with the code tag. It may be given several times,
+// the first matching pattern applying. New returns an error if pattern is not
+// valid or has no measurement group.
+func WithCounterNameTags(pattern string) Option {
+	return func(r *Reporter) {
+		r.counterPatterns = append(r.counterPatterns, pattern)
+	}
+}
+
+// WithCounterCountAndDelta reports each counter as both its cumulative count
+// (<name>.count) and its increase since the previous flush (<name>.count_delta)
+// in the same point, e.g. while dashboards migrate from one to the other. It
+// takes precedence over WithCounterDeltas.
+func WithCounterCountAndDelta() Option {
+	return func(r *Reporter) {
+		r.counterTotals = newCountCache()
+	}
+}
+
+// WithGaugeDeltas reports the gauges for which fn returns true, e.g. totals
+// exposed as gauges, as their change since the previous flush instead of
+// their value, with the same timestamps as WithCounterDeltas.
+func WithGaugeDeltas(fn func(name string) bool) Option {
+	return func(r *Reporter) {
+		r.gaugeDeltas = newCountCache()
+		r.gaugeDeltaFunc = fn
+	}
+}
+
+// WithIntervalSeconds adds an interval_seconds field to the counter points
+// reported with WithCounterDeltas, holding the time between the timestamps of
+// consecutive flushes, so that rates can be computed from the deltas. The
+// first interval after a start runs from the creation of the reporter to the
+// first flush, and is thus partial and, with alignment, irregular.
+func WithIntervalSeconds() Option {
+	return func(r *Reporter) {
+		r.intervalSeconds = true
+	}
+}
+
+// WithMeasurementTagKey writes every point to the single measurement
+// shared, storing the measurement it would otherwise have been written to in
+// the tag key. This keeps the number of measurements low, e.g. in cloud tiers
+// billing per measurement.
+func WithMeasurementTagKey(shared, key string) Option {
+	return func(r *Reporter) {
+		r.sharedMeasurement = shared
+		r.measurementTagKey = key
+	}
+}
+
+// WithSampleRate reports the named metric only with probability rate at each
+// flush, reducing the write volume of noisy metrics while the others keep
+// full fidelity.
+func WithSampleRate(name string, rate float64) Option {
+	return func(r *Reporter) {
+		if r.sampleRates == nil {
+			r.sampleRates = map[string]float64{}
+		}
+		r.sampleRates[name] = rate
+	}
+}
+
+// WithSampleSeed seeds the random source of WithSampleRate, making sampling
+// deterministic. By default it is seeded with the current time.
+func WithSampleSeed(seed int64) Option {
+	return func(r *Reporter) {
+		r.rand = rand.New(rand.NewSource(seed))
+	}
+}
+
+// WithTimerRates selects whether timers report their rates (m1, m5, m15 and
+// meanrate), the default, or only their distribution when rates is false.
+func WithTimerRates(rates bool) Option {
+	return func(r *Reporter) {
+		r.noTimerRates = !rates
+	}
+}
+
+// WithNameTag adds a tag with the given key holding the metric name to the
+// points of every metric.
+func WithNameTag(key string) Option {
+	return func(r *Reporter) {
+		r.nameTag = key
+	}
+}
+
+// WithDefaultFieldKey replaces the <name>.<type> field keys with the literal
+// key, the metric name being carried by the name tag (see WithNameTag, which
+// defaults to "name" with this option). Counters and gauges write their value
+// to key, histograms, meters and timers each statistic to key.<stat>, e.g.
+// value.p99.
+func WithDefaultFieldKey(key string) Option {
+	return func(r *Reporter) {
+		r.defaultFieldKey = key
+	}
+}
+
+// WithStatsFields selects which of the mean, min, max, stddev and variance
+// statistics of histograms and timers are reported, e.g. to drop stddev and
+// variance which few dashboards use. Counts and percentiles are always
+// reported.
+func WithStatsFields(mean, min, max, stddev, variance bool) Option {
+	return func(r *Reporter) {
+		r.omitStats = make(map[string]bool)
+		for stat, keep := range map[string]bool{
+			"mean":     mean,
+			"min":      min,
+			"max":      max,
+			"stddev":   stddev,
+			"variance": variance,
+		} {
+			if !keep {
+				r.omitStats[stat] = true
+			}
+		}
+	}
+}
+
+// WithStatNames renames the statistics of histograms, meters and timers, in
+// both the bucket tag and the field key, e.g. {"stddev": "std_dev"}.
+func WithStatNames(names map[string]string) Option {
+	return func(r *Reporter) {
+		r.statNames = names
+	}
+}
+
+// WithOnReconnect calls fn each time the client is recreated because of a
+// failure, with a reason describing it: a failed ping or a rejected token.
+func WithOnReconnect(fn func(reason string)) Option {
+	return func(r *Reporter) {
+		r.onReconnect = fn
+	}
+}
+
+// WithMeterCountDeltas reports the count of meters as its increase since the
+// previous flush instead of the cumulative count, like WithCounterDeltas
+// does for counters. The rates are still those computed by go-metrics.
+func WithMeterCountDeltas() Option {
+	return func(r *Reporter) {
+		r.meterDeltas = newCountCache()
+	}
+}
+
+// WithSendErrorLogThrottle throttles the logging of failed sends, failed
+// asynchronous writes and failed pings during an outage: the first failure is
+// logged, then every nth consecutive failure and any failure happening period
+// after the last logged one. Zero disables either threshold. A message is
+// logged once sending succeeds again.
+func WithSendErrorLogThrottle(every int, period time.Duration) Option {
+	return func(r *Reporter) {
+		r.sendFailures.every = every
+		r.sendFailures.period = period
+	}
+}
+
+// WithSink hands the points of every flush to sink instead of writing them
+// to InfluxDB. The url, org, bucket and token are then unused, as is
+// WriteRecords.
+func WithSink(sink Sink) Option {
+	return func(r *Reporter) {
+		r.sink = sink
+	}
+}
+
+// WithFieldTypeMap writes the fields with the given keys, e.g. "requests.count",
+// as the given type, which resolves field type conflicts with existing series
+// in InfluxDB.
+func WithFieldTypeMap(types map[string]FieldType) Option {
+	return func(r *Reporter) {
+		r.fieldTypes = types
+	}
+}
+
+// WithFieldBlocklist never writes the fields whose key is one of suffixes or
+// ends with one after a dot or an underscore, e.g. "variance" and "stddev"
+// for every histogram and timer, whatever the type of their metric. Points
+// whose bucket tag holds one of suffixes are dropped as well, as are the
+// points left without fields.
+func WithFieldBlocklist(suffixes ...string) Option {
+	return func(r *Reporter) {
+		r.fieldBlocklist = append(r.fieldBlocklist, suffixes...)
+	}
+}
+
+// WithRoundFields rounds the float fields of the metrics of the given type to
+// places decimal places, e.g. the percentiles of timers to fewer places than
+// the rates of meters, to reduce the size of the payload. Fields are written
+// with full precision by default.
+func WithRoundFields(t MetricType, places int) Option {
+	return func(r *Reporter) {
+		if r.typePrecision == nil {
+			r.typePrecision = map[MetricType]int{}
+		}
+		r.typePrecision[t] = places
+	}
+}
+
+// WithFieldPrecision rounds the float fields with the given keys, e.g.
+// "latency.timer" with the default bucket tag or "latency.timer.p99" with
+// WithDefaultFieldKey, to the given number of decimal places. It takes
+// precedence over WithRoundFields.
+func WithFieldPrecision(precision map[string]int) Option {
+	return func(r *Reporter) {
+		r.fieldPrecision = precision
+	}
+}
+
+// WithDebugWriter writes the points of every flush to w as line protocol, in
+// addition to writing them to InfluxDB, e.g. os.Stderr to see what is sent.
+// Tags and fields are sorted, so that the output is stable.
+func WithDebugWriter(w io.Writer) Option {
+	return func(r *Reporter) {
+		r.debugWriter = w
+	}
+}
+
+// WithCounterField replaces the count suffix of the field key of counters,
+// e.g. with total to follow the Prometheus convention.
+func WithCounterField(suffix string) Option {
+	return func(r *Reporter) {
+		r.counterField = suffix
+	}
+}
+
+// WithGaugeField replaces the gauge suffix of the field key of gauges.
+func WithGaugeField(suffix string) Option {
+	return func(r *Reporter) {
+		r.gaugeField = suffix
+	}
+}
+
+// WithHealthcheckErrorLength caps the length of the error tag of unhealthy
+// healthchecks to n bytes (64 by default), 0 omitting the tag. New fails if
+// n is negative.
+func WithHealthcheckErrorLength(n int) Option {
+	return func(r *Reporter) {
+		r.healthErrorLen = n
+	}
+}
+
+// WithRunHealthchecks runs the check of every healthcheck at each flush
+// before reporting its error. The checks then run on the reporting goroutine,
+// unbounded by WithMetricTimeout, so they must be quick. By default the error
+// of the last check run by the application is reported.
+func WithRunHealthchecks() Option {
+	return func(r *Reporter) {
+		r.runHealthchecks = true
+	}
+}
+
+// WithStartupFlush flushes as soon as the reporting loop starts instead of
+// one interval later, so that the metrics of short-lived jobs are written
+// and dashboards fill up right away.
+func WithStartupFlush() Option {
+	return func(r *Reporter) {
+		r.startupFlush = true
+	}
+}
+
+// WithMetricEvery reports the named metric only once every n flushes, e.g. a
+// slow-changing gauge, starting with the first flush. It takes precedence
+// over WithTypeEvery. The deltas and interval rates of the metric cover the
+// flushes it was skipped by.
+func WithMetricEvery(name string, n int) Option {
+	return func(r *Reporter) {
+		if r.everyNames == nil {
+			r.everyNames = map[string]int64{}
+		}
+		r.everyNames[name] = int64(n)
+		if r.flushCounts == nil {
+			r.flushCounts = newCountCache()
+		}
+	}
+}
+
+// WithTypeEvery reports the metrics of the given type only once every n
+// flushes, starting with the first flush.
+func WithTypeEvery(t MetricType, n int) Option {
+	return func(r *Reporter) {
+		if r.everyTypes == nil {
+			r.everyTypes = map[MetricType]int64{}
+		}
+		r.everyTypes[t] = int64(n)
+		if r.flushCounts == nil {
+			r.flushCounts = newCountCache()
+		}
+	}
+}
+
+// WithMeasurementSanitizer applies fn to the measurement of every point,
+// whichever option it comes from. The default sanitizer replaces control
+// characters, which line protocol cannot escape, with underscores.
+func WithMeasurementSanitizer(fn func(string) string) Option {
+	return func(r *Reporter) {
+		r.measurementSanitizer = fn
+	}
+}
+
+// WithTimerSplit writes each timer as two logical metrics, for dashboards
+// built for separate histogram and meter panels: its distribution as a
+// histogram (<name>.histogram fields) to distMeasurement and its rates as a
+// meter (<name>.meter fields: count, m1, m5, m15 and mean) to
+// ratesMeasurement. An empty measurement is the one of the other statistics.
+func WithTimerSplit(distMeasurement, ratesMeasurement string) Option {
+	return func(r *Reporter) {
+		r.splitTimers = true
+		r.timerDistMeasurement = distMeasurement
+		r.timerRatesMeasurement = ratesMeasurement
+	}
+}
+
+// WithChangedOnly only writes the metrics whose values changed since they
+// were last written, but at least once every maxStale so that dashboards do
+// not show gaps. This saves writes for mostly static registries.
+func WithChangedOnly(maxStale time.Duration) Option {
+	return func(r *Reporter) {
+		r.changeHashes = newCountCache()
+		r.changeTimes = newCountCache()
+		r.maxStale = maxStale
+	}
+}
+
+// WithConcurrency builds the points of a flush across n goroutines, for
+// registries so large that building them takes a significant part of the
+// interval. The points are still written in a single batch. Callbacks such
+// as the metric error handler may then be called concurrently.
+func WithConcurrency(n int) Option {
+	return func(r *Reporter) {
+		r.concurrency = n
+	}
+}
+
+// WithRetentionPolicy writes to the given retention policy of the database
+// named by the bucket, through the 1.8 write compatibility which addresses it
+// as database/retention-policy. Buckets which already name a retention
+// policy, e.g. one given to WithBucketForTypes, are left alone.
+func WithRetentionPolicy(rp string) Option {
+	return func(r *Reporter) {
+		r.retentionPolicy = rp
+	}
+}
+
+// WithReporterTags attaches the given tags, e.g. source=reporter, only to
+// the points about the reporter itself: the heartbeat, info, scrape status
+// and registry size points. This tells them apart from the application
+// metrics in a shared measurement.
+func WithReporterTags(tags map[string]string) Option {
+	return func(r *Reporter) {
+		r.reporterTags = tags
+	}
+}
+
+// WithQuantileTag writes the percentiles of histograms and timers with their
+// quantile in the tag key, e.g. quantile=0.99, instead of the p50 to p9999
+// bucket tags and field keys. Each percentile point then has the single field
+// of its metric, e.g. <name>.timer or the default field key.
+func WithQuantileTag(key string) Option {
+	return func(r *Reporter) {
+		r.quantileTag = key
+	}
+}
+
+// WithSkippedTicksGauge registers a gauge of SkippedTicks under name in reg,
+// e.g. the reported registry, unless a metric is already registered there.
+// The gauge is registered by New once the reporter is created.
+func WithSkippedTicksGauge(reg metrics.Registry, name string) Option {
+	return func(r *Reporter) {
+		r.skippedTicksReg, r.skippedTicksName = reg, name
+	}
+}
+
+// WithRegistrySnapshot first collects the metrics of the registries with
+// Each, then reads them once the iteration is over, for registries which do
+// not support their metrics being read or reset from within Each.
+func WithRegistrySnapshot() Option {
+	return func(r *Reporter) {
+		r.snapshotRegistry = true
+	}
+}
+
+// WithFieldValueClamp bounds float field values to [min, max], so that a
+// single bogus sample, e.g. a huge duration recorded across a clock jump,
+// does not skew dashboards. Clamped values are counted in ClampedValues.
+func WithFieldValueClamp(min, max float64) Option {
+	return func(r *Reporter) {
+		r.clamp = true
+		r.clampMin, r.clampMax = min, max
+	}
+}
+
+// WithScrapeStatus writes two points to measurement after every flush, like
+// the series Prometheus records for each scrape: scrape_duration_seconds, the
+// time taken to build and write the flush, and scrape_success, 1 if it was
+// written or 0. They carry the reporter tags. With the InfluxDB v2 client, the
+// points are then written synchronously (see v2Writer).
+func WithScrapeStatus(measurement string) Option {
+	return func(r *Reporter) {
+		r.scrapeMeasurement = measurement
+	}
+}
+
+// WithOrderedFields sorts the fields of the written points by key, so that
+// the line protocol sent is deterministic, e.g. for golden file tests. The
+// debug writers always sort fields.
+func WithOrderedFields() Option {
+	return func(r *Reporter) {
+		r.orderedFields = true
+	}
+}
+
+// WithJSONDebugWriter writes the points of every flush to w as JSON, one
+// object with measurement, tags, fields and time per line, e.g. to pipe them
+// into jq during development.
+func WithJSONDebugWriter(w io.Writer) Option {
+	return func(r *Reporter) {
+		r.jsonDebugWriter = w
+	}
+}
+
+// WithStartTimeout makes New check that InfluxDB is ready, waiting at most d,
+// and return an error if it is not, so that startup fails predictably rather
+// than metrics being silently lost.
+func WithStartTimeout(d time.Duration) Option {
+	return func(r *Reporter) {
+		r.startTimeout = d
+	}
+}
+
+// WithLazyStart makes New only log a failed WithStartTimeout check and
+// return the reporter, which connects on its first flush.
+func WithLazyStart() Option {
+	return func(r *Reporter) {
+		r.lazyStart = true
+	}
+}
+
+// WithEnqueueLimit bounds the number of points queued by Enqueue between two
+// flushes, 10000 by default.
+func WithEnqueueLimit(n int) Option {
+	return func(r *Reporter) {
+		r.queueLimit = n
+	}
+}
+
+// WithRetries retries a write which failed with a retryable error up to n
+// times, waiting backoff before the first retry and twice as long before
+// every next one, within the write timeout. With the InfluxDB v2 client, the
+// points are then written synchronously (see v2Writer), so that only the
+// errors accepted by WithRetryableErrorFunc are retried.
+func WithRetries(n int, backoff time.Duration) Option {
+	return func(r *Reporter) {
+		r.retries = n
+		r.retryBackoff = backoff
+	}
+}
+
+// WithRetryableErrorFunc decides which write errors WithRetries retries. By
+// default server errors (5xx), rate limiting (429) and connectivity errors
+// are retried while other client errors (4xx), which would fail identically,
+// are not.
+func WithRetryableErrorFunc(fn func(error) bool) Option {
+	return func(r *Reporter) {
+		r.retryable = fn
+	}
+}
+
+// WithMaxPointSize drops the points of metrics whose line protocol exceeds
+// size bytes, e.g. because of a long string field, rather than letting InfluxDB
+// reject the whole batch. Dropped points are logged with their metric name and
+// counted in DroppedPoints.
+func WithMaxPointSize(size int) Option {
+	return func(r *Reporter) {
+		r.maxPointSize = size
+	}
+}
+
+// WithConsistency sets the consistency of the writes to a clustered InfluxDB
+// Enterprise: one, any, quorum or all. It is ignored, with a warning, by
+// WithV3 and WithSink.
+func WithConsistency(consistency string) Option {
+	return func(r *Reporter) {
+		r.consistency = consistency
+	}
+}
+
+// WithBucketCreate creates the bucket in the org when the check made before
+// the first flush finds it missing, e.g. in development environments, with
+// the given retention (0 keeping data forever). The token must be allowed to
+// write buckets, which is why this is opt-in.
+func WithBucketCreate(retention time.Duration) Option {
+	return func(r *Reporter) {
+		r.createBucket = true
+		r.bucketRetention = retention
+	}
+}
+
+// WithMeasurementFromPrefix derives the measurement of each metric from the
+// first depth dot-separated segments of its name, the rest making up its
+// field keys: at depth 1, db.query.latency is written to the db measurement
+// as query.latency.timer fields. Metrics with too few segments keep the
+// reporter's measurements.
+func WithMeasurementFromPrefix(depth int) Option {
+	return func(r *Reporter) {
+		r.prefixDepth = depth
+	}
+}
+
+// WithTLSInsecureSkipVerify disables the verification of the certificate of
+// InfluxDB, e.g. for a development cluster with a self-signed certificate.
+// Connections can then be intercepted, so a warning is logged at startup.
+func WithTLSInsecureSkipVerify() Option {
+	return func(r *Reporter) {
+		if r.tlsConfig == nil {
+			r.tlsConfig = &tls.Config{}
+		}
+		r.tlsConfig.InsecureSkipVerify = true
+	}
+}
+
+// WithRegistrySizeMetric writes the number of metrics in the registries at
+// every flush as a registry.size field. A sudden jump often reveals metrics
+// registered per request or per user.
+func WithRegistrySizeMetric() Option {
+	return func(r *Reporter) {
+		r.registrySize = true
+	}
+}
+
+// WithDeadline stops the reporting loop at t, e.g. at the end of a timed load
+// test, as if Stop was called: the final flush is performed and the client
+// closed. A deadline of the context given to Start or Run has the same
+// effect.
+func WithDeadline(t time.Time) Option {
+	return func(r *Reporter) {
+		r.deadline = t
+	}
+}
+
+// WithHistogramBuckets adds the sum of histograms and cumulative bucket counts
+// to their statistics, like Prometheus histograms, for quantiles computed by
+// InfluxDB: le_<bound> is the number of samples less than or equal to each of
+// bounds and le_+Inf the count of samples. The bucket counts are estimated
+// from at most maxSamples of the samples kept by each histogram, all of them
+// when maxSamples is 0 or negative. Timers do not expose their samples and are
+// left alone.
+func WithHistogramBuckets(bounds []float64, maxSamples int) Option {
+	return func(r *Reporter) {
+		r.histogramBounds = bounds
+		r.maxBucketSamples = maxSamples
+	}
+}
+
+// WithShutdownTimeout bounds the final flush and the closing of the client
+// performed when the reporter stops, so that the process can exit promptly
+// even when InfluxDB is unreachable. A final flush taking longer is logged
+// and abandoned.
+func WithShutdownTimeout(d time.Duration) Option {
+	return func(r *Reporter) {
+		r.shutdownTimeout = d
+	}
+}
+
+// WithFieldTemplate produces the field keys from a text/template referencing
+// the metric name (.Name), its type suffix (.Type: count, gauge, histogram,
+// meter, timer or healthy) and the statistic (.Stat, e.g. p99, or the type
+// suffix for counters, gauges and healthchecks). E.g. {{.Name}}_{{.Stat}}
+// writes http_latency_p99 and requests_count. It takes precedence over
+// WithDefaultFieldKey. New returns an error if the template is invalid.
+func WithFieldTemplate(tmpl string) Option {
+	return func(r *Reporter) {
+		r.fieldTemplate = tmpl
+	}
+}
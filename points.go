@@ -0,0 +1,1256 @@
+package influxdb
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	client "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"github.com/rcrowley/go-metrics"
+)
+
+// each calls fn for every metric of the reported registries together with
+// the tags of its points. Metrics of additional registries are prefixed and
+// tagged as configured with WithRegistry.
+func (r *Reporter) each(fn func(name string, tags map[string]string, i interface{})) {
+	r.reg.Each(func(name string, i interface{}) {
+		fn(name, r.tags, i)
+	})
+	for _, extra := range r.registries {
+		tags := r.tags
+		if len(extra.tags) > 0 {
+			tags = make(map[string]string, len(r.tags)+len(extra.tags))
+			for k, v := range r.tags {
+				tags[k] = v
+			}
+			for k, v := range extra.tags {
+				tags[k] = v
+			}
+		}
+		extra.reg.Each(func(name string, i interface{}) {
+			fn(extra.prefix+name, tags, i)
+		})
+	}
+}
+
+// timestamp returns the timestamp of the points of a flush happening now.
+func (r *Reporter) timestamp() time.Time {
+	now := r.now()
+	if !r.align {
+		return now
+	}
+	if r.alignMode == AlignWallClock {
+		midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+		return midnight.Add(now.Sub(midnight).Truncate(r.interval))
+	}
+	return now.Truncate(r.interval)
+}
+
+// now returns the current time, truncated to the second with
+// WithSecondPrecision.
+func (r *Reporter) now() time.Time {
+	if r.seconds {
+		return r.clock().Truncate(time.Second)
+	}
+	return r.clock()
+}
+
+// typeEnabled reports whether the metrics of type t are reported.
+func (r *Reporter) typeEnabled(t MetricType) bool {
+	if r.disabledTypes[t] {
+		return false
+	}
+	return r.enabledTypes == nil || r.enabledTypes[t]
+}
+
+// batch collects the points of a flush.
+type batch struct {
+	now    time.Time
+	commit bool
+	// deltaTime is the timestamp of the counter delta points, unique per flush.
+	deltaTime time.Time
+	// deltaInterval is the time covered by the counter deltas.
+	deltaInterval time.Duration
+	// wallTime is the unaligned time of the flush, set for unaligned counters.
+	wallTime time.Time
+	// flushTime is the actual time of the flush, set for the meter interval
+	// rates.
+	flushTime time.Time
+	// gaugeTime is the timestamp of the gauge points, unique per flush, set
+	// for AlignCollisionOffset.
+	gaugeTime time.Time
+	points    []*write.Point
+	// routed holds the points written to another bucket than the reporter's,
+	// by bucket.
+	routed map[string][]*write.Point
+	// records holds the line protocol records forwarded by the flush.
+	records []string
+	// info is set when the batch holds the info point.
+	info bool
+	// single backs the fields of every single-field point. NewPoint copies
+	// the fields it is given, so the map is reused rather than allocating one
+	// per point.
+	single map[string]interface{}
+}
+
+func newBatch(now time.Time, commit bool) *batch {
+	return &batch{
+		now:    now,
+		commit: commit,
+		single: make(map[string]interface{}, 1),
+	}
+}
+
+// header returns an empty batch of the same flush as b, carrying its
+// flush-level times, into which part of its points can be built.
+func (b *batch) header() *batch {
+	h := *b
+	h.points, h.routed, h.records = nil, nil, nil
+	h.single = make(map[string]interface{}, 1)
+	return &h
+}
+
+// field returns the fields of a point holding only key=v.
+func (b *batch) field(key string, v interface{}) map[string]interface{} {
+	for k := range b.single {
+		delete(b.single, k)
+	}
+	b.single[key] = v
+	return b.single
+}
+
+func (b *batch) add(p *write.Point) {
+	b.points = append(b.points, p)
+}
+
+// route moves the points added since the n-th one to bucket.
+func (b *batch) route(n int, bucket string) {
+	if b.routed == nil {
+		b.routed = make(map[string][]*write.Point)
+	}
+	b.routed[bucket] = append(b.routed[bucket], b.points[n:]...)
+	b.points = b.points[:n]
+}
+
+// validate drops the points added since the n-th one which hold a NaN or
+// infinite field value, which cannot be encoded as line protocol.
+func (b *batch) validate(n int) error {
+	var invalid []string
+	valid := b.points[:n]
+	for _, p := range b.points[n:] {
+		ok := true
+		for _, f := range p.FieldList() {
+			if v, isFloat := f.Value.(float64); isFloat && (math.IsNaN(v) || math.IsInf(v, 0)) {
+				invalid = append(invalid, f.Key)
+				ok = false
+			}
+		}
+		if ok {
+			valid = append(valid, p)
+		}
+	}
+	b.points = valid
+	if len(invalid) > 0 {
+		return fmt.Errorf("invalid value for fields %v", invalid)
+	}
+	return nil
+}
+
+// points builds the points for every metric in the registry, timestamped with
+// now. The per-metric caches are only updated when commit is set, so that
+// points can also be rendered outside of a flush.
+func (r *Reporter) points(now time.Time, commit bool) *batch {
+	r.pointsMu.Lock()
+	defer r.pointsMu.Unlock()
+
+	b := newBatch(now, commit)
+	if r.unalignedCounters {
+		b.wallTime = r.now()
+	}
+	if r.meterRates != nil {
+		b.flushTime = r.clock()
+	}
+	if r.counterDeltas != nil || r.meterDeltas != nil || r.gaugeDeltas != nil {
+		prev := r.lastDeltaTime
+		if prev.IsZero() {
+			prev = r.created
+		}
+		base := now
+		if r.unalignedCounters {
+			base = b.wallTime
+		}
+		b.deltaTime = r.uniqueTime(&r.lastDeltaTime, base, commit)
+		b.deltaInterval = b.deltaTime.Sub(prev)
+	}
+	if r.align && r.alignCollision == AlignCollisionOffset {
+		b.gaugeTime = r.uniqueTime(&r.lastGaugeTime, now, commit)
+	}
+	// entries collects the metrics to build concurrently.
+	var entries []entry
+	// size counts the metrics of the registries.
+	var size int64
+	add := func(name string, tags map[string]string, i interface{}) {
+		size++
+		t, ok := metricTypeOf(i)
+		if ok && !r.typeEnabled(t) {
+			return
+		}
+		if r.stripPrefix != "" {
+			name = strings.TrimPrefix(name, r.stripPrefix)
+		}
+		if r.nameRewriter != nil {
+			name = r.nameRewriter(name)
+		}
+		if r.allowlist != nil && !r.allowlist[name] {
+			return
+		}
+		// Only flushes draw from the random source, so that rendering the
+		// registry over HTTP neither races with them nor shifts their
+		// sampling.
+		if rate, ok := r.sampleRates[name]; ok && commit && r.rand.Float64() >= rate {
+			r.keepCaches(name)
+			return
+		}
+		if every := r.every(name, t, ok); every > 1 && r.flushCounts.add(name, 1, commit)%every != 0 {
+			if commit {
+				r.keepCaches(name)
+			}
+			return
+		}
+		e := entry{name: name, tags: r.metricTags(name, tags), metric: i, typ: t, typed: ok}
+		if r.concurrency > 1 {
+			entries = append(entries, e)
+			return
+		}
+		r.addEntry(b, e)
+	}
+	if r.snapshotRegistry {
+		// Read the metrics outside of the registry's iteration.
+		var collected []entry
+		r.each(func(name string, tags map[string]string, i interface{}) {
+			collected = append(collected, entry{name: name, tags: tags, metric: i})
+		})
+		for _, e := range collected {
+			add(e.name, e.tags, e.metric)
+		}
+	} else {
+		r.each(add)
+	}
+	if len(entries) > 0 {
+		r.addEntries(b, entries)
+	}
+	if commit {
+		r.pruneCaches()
+	}
+
+	if r.heartbeat != "" {
+		b.add(r.newPoint(r.measurement,
+			r.internalTags(),
+			b.field(r.heartbeat, 1),
+			now))
+	}
+	if r.registrySize {
+		b.add(r.newPoint(r.measurement,
+			r.internalTags(),
+			b.field("registry.size", size),
+			now))
+	}
+	if r.exportField != "" {
+		r.addExportTime(b)
+	}
+	if commit {
+		points, records := r.dequeue()
+		b.points = append(b.points, points...)
+		b.records = records
+	}
+	if r.infoTags != nil && commit && !r.infoWritten {
+		b.info = true
+		b.add(r.infoPoint(now))
+	}
+	return b
+}
+
+// addExportTime adds the export field, holding the current time in epoch
+// milliseconds however the points are timestamped, to the points of b.
+func (r *Reporter) addExportTime(b *batch) {
+	ms := time.Now().UnixNano() / int64(time.Millisecond)
+	add := func(points []*write.Point) {
+		for _, p := range points {
+			p.AddField(r.exportField, ms)
+			if r.orderedFields {
+				p.SortFields()
+			}
+		}
+	}
+	add(b.points)
+	for _, points := range b.routed {
+		add(points)
+	}
+}
+
+// entry is a metric to build points for.
+type entry struct {
+	name   string
+	tags   map[string]string
+	metric interface{}
+	typ    MetricType
+	typed  bool
+}
+
+// addEntry adds the points of a metric to b.
+func (r *Reporter) addEntry(b *batch, e entry) {
+	n := len(b.points)
+	r.addMetric(b, e.name, e.tags, e.metric)
+	if len(r.fieldBlocklist) > 0 {
+		r.dropBlocked(b, n)
+	}
+	if r.typePrecision != nil || r.fieldPrecision != nil {
+		r.round(b.points[n:], e.typ, e.typed)
+	}
+	if r.maxPointSize > 0 {
+		r.dropOversized(b, n, e.name)
+	}
+	if r.changeHashes != nil && b.commit && r.unchanged(e.name, b.points[n:], b.now) {
+		b.points = b.points[:n]
+	}
+	if bucket, routed := r.typeBuckets[e.typ]; e.typed && routed {
+		b.route(n, bucket)
+	}
+}
+
+// dropBlocked removes the fields matching the field blocklist from the points
+// added since the n-th one, dropping the points left without fields. The
+// statistic of a point of a histogram, meter or timer, carried by its bucket
+// tag, is matched as well.
+func (r *Reporter) dropBlocked(b *batch, n int) {
+	kept := b.points[:n]
+	for _, p := range b.points[n:] {
+		if r.blockedStat(p) {
+			continue
+		}
+		fields := make(map[string]interface{}, len(p.FieldList()))
+		for _, f := range p.FieldList() {
+			if !r.blockedField(f.Key) {
+				fields[f.Key] = f.Value
+			}
+		}
+		switch len(fields) {
+		case 0:
+		case len(p.FieldList()):
+			kept = append(kept, p)
+		default:
+			tags := make(map[string]string, len(p.TagList()))
+			for _, t := range p.TagList() {
+				tags[t.Key] = t.Value
+			}
+			kept = append(kept, client.NewPoint(p.Name(), tags, fields, p.Time()))
+		}
+	}
+	b.points = kept
+}
+
+// blockedField reports whether key is a blocked suffix or ends with one after
+// a dot or an underscore.
+func (r *Reporter) blockedField(key string) bool {
+	for _, suffix := range r.fieldBlocklist {
+		if key == suffix || strings.HasSuffix(key, "."+suffix) || strings.HasSuffix(key, "_"+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// blockedStat reports whether the bucket tag of p is a blocked suffix.
+func (r *Reporter) blockedStat(p *write.Point) bool {
+	for _, t := range p.TagList() {
+		if t.Key != "bucket" {
+			continue
+		}
+		for _, suffix := range r.fieldBlocklist {
+			if t.Value == suffix {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// round rounds the float fields of points to the decimal places set for their
+// key or, failing that, for the type of their metric.
+func (r *Reporter) round(points []*write.Point, t MetricType, typed bool) {
+	typePlaces, byType := r.typePrecision[t]
+	byType = byType && typed
+	for _, p := range points {
+		for _, f := range p.FieldList() {
+			v, ok := f.Value.(float64)
+			if !ok {
+				continue
+			}
+			places, ok := r.fieldPrecision[f.Key]
+			if !ok {
+				places, ok = typePlaces, byType
+			}
+			if ok {
+				pow := math.Pow(10, float64(places))
+				f.Value = math.Round(v*pow) / pow
+			}
+		}
+	}
+}
+
+// dropOversized drops the points added to b since the n-th one, those of
+// the named metric, whose line protocol exceeds the maximum point size.
+func (r *Reporter) dropOversized(b *batch, n int, name string) {
+	kept := b.points[:n]
+	for _, p := range b.points[n:] {
+		if size := len(write.PointToLineProtocol(p, time.Nanosecond)); size > r.maxPointSize {
+			atomic.AddInt64(&r.droppedPoints, 1)
+			r.logf("dropping a point of metric %s exceeding the maximum point size. size=%d", name, size)
+			continue
+		}
+		kept = append(kept, p)
+	}
+	b.points = kept
+}
+
+// addEntries adds the points of the metrics to b, building them across
+// r.concurrency goroutines. Each goroutine builds its share into its own
+// batch, the batches are then appended to b in order.
+func (r *Reporter) addEntries(b *batch, entries []entry) {
+	size := (len(entries) + r.concurrency - 1) / r.concurrency
+	var batches []*batch
+	var wg sync.WaitGroup
+	for start := 0; start < len(entries); start += size {
+		end := start + size
+		if end > len(entries) {
+			end = len(entries)
+		}
+		wb := b.header()
+		batches = append(batches, wb)
+
+		wg.Add(1)
+		go func(wb *batch, entries []entry) {
+			defer wg.Done()
+			for _, e := range entries {
+				r.addEntry(wb, e)
+			}
+		}(wb, entries[start:end])
+	}
+	wg.Wait()
+
+	for _, wb := range batches {
+		b.points = append(b.points, wb.points...)
+		for bucket, points := range wb.routed {
+			if b.routed == nil {
+				b.routed = make(map[string][]*write.Point)
+			}
+			b.routed[bucket] = append(b.routed[bucket], points...)
+		}
+	}
+}
+
+// newPoint creates a point of the given logical measurement. NewPoint copies
+// tags and fields, so callers may reuse them.
+func (r *Reporter) newPoint(measurement string, tags map[string]string, fields map[string]interface{}, ts time.Time) *write.Point {
+	var p *write.Point
+	if r.measurementTagKey == "" {
+		p = client.NewPoint(r.measurementSanitizer(measurement), tags, fields, ts)
+	} else {
+		p = client.NewPoint(r.measurementSanitizer(r.sharedMeasurement), tags, fields, ts)
+		p.AddTag(r.measurementTagKey, measurement).SortTags()
+	}
+	if len(r.fieldTypes) > 0 {
+		for _, f := range p.FieldList() {
+			if t, ok := r.fieldTypes[f.Key]; ok {
+				f.Value = coerceField(f.Value, t)
+			}
+		}
+	}
+	if r.clamp {
+		for _, f := range p.FieldList() {
+			if v, ok := f.Value.(float64); ok && (v < r.clampMin || v > r.clampMax) {
+				f.Value = math.Max(r.clampMin, math.Min(r.clampMax, v))
+				atomic.AddInt64(&r.clampedValues, 1)
+			}
+		}
+	}
+	if r.orderedFields {
+		p.SortFields()
+	}
+	return p
+}
+
+// sanitizeMeasurement is the default measurement sanitizer. It replaces the
+// control characters, which line protocol cannot escape, with underscores.
+func sanitizeMeasurement(measurement string) string {
+	return strings.Map(func(c rune) rune {
+		if unicode.IsControl(c) {
+			return '_'
+		}
+		return c
+	}, measurement)
+}
+
+// coerceField converts a field value, as normalized by NewPoint, to the given
+// type.
+func coerceField(v interface{}, t FieldType) interface{} {
+	var f float64
+	switch v := v.(type) {
+	case int64:
+		f = float64(v)
+	case uint64:
+		f = float64(v)
+	case float64:
+		f = v
+	case bool:
+		if v {
+			f = 1
+		}
+	case string:
+		if t == FieldString {
+			return v
+		}
+		parsed, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return v
+		}
+		f = parsed
+	default:
+		return v
+	}
+	switch t {
+	case FieldInt:
+		if i, ok := v.(int64); ok {
+			return i
+		}
+		return int64(f)
+	case FieldFloat:
+		return f
+	case FieldBool:
+		return f != 0
+	case FieldString:
+		return fmt.Sprint(v)
+	}
+	return v
+}
+
+// uniqueTime returns now, moved forward if needed to be later than last, the
+// timestamp returned for the previous flush, which is updated when commit is
+// set. Alignment may give consecutive flushes the same timestamp, in which
+// case InfluxDB would keep only the last of their points.
+func (r *Reporter) uniqueTime(last *time.Time, now time.Time, commit bool) time.Time {
+	if !now.After(*last) {
+		step := time.Nanosecond
+		if r.seconds {
+			step = time.Second
+		}
+		now = last.Add(step)
+	}
+	if commit {
+		*last = now
+	}
+	return now
+}
+
+// addMetric adds the points of a single metric to b. A panic or an invalid
+// value is reported to the metric error handler and only affects the points
+// of that metric, the rest of the flush proceeds.
+func (r *Reporter) addMetric(b *batch, name string, tags map[string]string, i interface{}) {
+	n := len(b.points)
+	defer func() {
+		if err := recover(); err != nil {
+			b.points = b.points[:n]
+			r.metricError(name, fmt.Errorf("panic while building points: %v", err))
+			return
+		}
+		if err := b.validate(n); err != nil {
+			r.metricError(name, err)
+		}
+	}()
+
+	if r.metricTimeout > 0 {
+		var err error
+		if i, err = r.evalFunctional(i); err != nil {
+			r.metricError(name, err)
+			return
+		}
+	}
+	ts := b.now
+	if r.timestampFunc != nil {
+		if t, ok := r.timestampFunc(name, i); ok {
+			ts = t
+		}
+	}
+	// measurement and stats are the measurements of the points of the
+	// metric, field the name its field keys are derived from.
+	measurement, stats, field := r.measurement, r.statsMeasurement(), name
+	if r.prefixDepth > 0 {
+		if prefix, rest, ok := splitPrefix(name, r.prefixDepth); ok {
+			measurement, stats, field = prefix, prefix, rest
+		}
+	}
+	switch metric := i.(type) {
+	case metrics.Counter:
+		ms := metric.Snapshot()
+		count := ms.Count()
+		if r.counterDeltas != nil && r.counterTotals == nil {
+			prev, _ := r.counterDeltas.swap(name, count, b.commit)
+			count -= prev
+			if ts.Equal(b.now) {
+				ts = b.deltaTime
+			}
+		} else if r.unalignedCounters && ts.Equal(b.now) {
+			ts = b.wallTime
+		}
+		key := r.fieldKey(field, r.counterField)
+		if len(r.counterRules) > 0 {
+			if m, extracted, ok := r.counterNameTags(name, tags); ok {
+				measurement, tags, key = m, extracted, r.counterField
+			}
+		}
+		fields := b.field(key, r.counterValue(count))
+		if r.counterTotals != nil {
+			// Only the delta is derived from the cache, the count is left as is.
+			prev, _ := r.counterTotals.swap(name, count, b.commit)
+			fields[key+"_delta"] = r.counterValue(count - prev)
+		}
+		if r.counterDeltas != nil && r.intervalSeconds {
+			fields["interval_seconds"] = b.deltaInterval.Seconds()
+		}
+		p := r.newPoint(measurement, tags, fields, ts)
+		b.add(p)
+	case metrics.Gauge:
+		ms := metric.Snapshot()
+		v := ms.Value()
+		if r.gaugeDeltas != nil && r.gaugeDeltaFunc(name) {
+			prev, _ := r.gaugeDeltas.swap(name, v, b.commit)
+			v -= prev
+			if ts.Equal(b.now) {
+				ts = b.deltaTime
+			}
+		} else if r.gaugeAggregates != nil && ts.Equal(b.now) {
+			v = int64(math.Round(r.gaugeAggregates.add(name, ts, float64(v), b.commit)))
+		}
+		ts = r.gaugeTimestamp(b, ts)
+		p := r.newPoint(measurement,
+			tags,
+			b.field(r.fieldKey(field, r.gaugeField), r.gaugeValue(v)),
+			ts)
+		b.add(p)
+	case metrics.GaugeFloat64:
+		ms := metric.Snapshot()
+		v := ms.Value()
+		if r.gaugeDeltas != nil && r.gaugeDeltaFunc(name) {
+			// The cache holds int64 values, float values are stored by bits.
+			prev, ok := r.gaugeDeltas.swap(name, int64(math.Float64bits(v)), b.commit)
+			if ok {
+				v -= math.Float64frombits(uint64(prev))
+			}
+			if ts.Equal(b.now) {
+				ts = b.deltaTime
+			}
+		} else if r.gaugeAggregates != nil && ts.Equal(b.now) {
+			v = r.gaugeAggregates.add(name, ts, v, b.commit)
+		}
+		ts = r.gaugeTimestamp(b, ts)
+		p := r.newPoint(measurement,
+			tags,
+			b.field(r.fieldKey(field, r.gaugeField), r.gaugeFloat64Value(v)),
+			ts)
+		b.add(p)
+	case metrics.Histogram:
+		ms := metric.Snapshot()
+		ps := ms.Percentiles([]float64{0.5, 0.75, 0.95, 0.99, 0.999, 0.9999})
+		fields := map[string]float64{
+			"count":    float64(ms.Count()),
+			"max":      float64(ms.Max()),
+			"mean":     ms.Mean(),
+			"min":      float64(ms.Min()),
+			"stddev":   ms.StdDev(),
+			"variance": ms.Variance(),
+			"p50":      ps[0],
+			"p75":      ps[1],
+			"p95":      ps[2],
+			"p99":      ps[3],
+			"p999":     ps[4],
+			"p9999":    ps[5],
+		}
+		if r.histogramBounds != nil {
+			r.addBuckets(fields, ms)
+		}
+		for k := range r.omitStats {
+			delete(fields, k)
+		}
+		if r.isIdle(name, ms.Count(), b.commit) {
+			fields = map[string]float64{"count": fields["count"]}
+		}
+		r.addStats(b, stats, field, "histogram", tags, fields, ts)
+	case metrics.Meter:
+		ms := metric.Snapshot()
+		count := ms.Count()
+		if r.meterDeltas != nil {
+			prev, _ := r.meterDeltas.swap(name, count, b.commit)
+			count -= prev
+			if ts.Equal(b.now) {
+				ts = b.deltaTime
+			}
+		}
+		fields := map[string]float64{
+			"count": float64(count),
+			"m1":    ms.Rate1(),
+			"m5":    ms.Rate5(),
+			"m15":   ms.Rate15(),
+			"mean":  ms.RateMean(),
+		}
+		r.addStats(b, stats, field, "meter", tags, fields, ts)
+		if r.meterRates != nil {
+			// The rate is computed over the time actually elapsed since the
+			// previous flush, which Flush and WithMinInterval make differ
+			// from the interval.
+			prev, ok := r.meterRates.swap(name, ms.Count(), b.commit)
+			prevTime, _ := r.meterRateTimes.swap(name, b.flushTime.UnixNano(), b.commit)
+			if elapsed := b.flushTime.Sub(time.Unix(0, prevTime)); ok && elapsed > 0 {
+				key := field + ".rate_interval"
+				switch {
+				case r.fieldTmpl != nil:
+					key = r.templateKey(field, "meter", "rate_interval")
+				case r.defaultFieldKey != "":
+					key = r.defaultFieldKey + ".rate_interval"
+				}
+				p := r.newPoint(measurement,
+					tags,
+					b.field(key, float64(ms.Count()-prev)/elapsed.Seconds()),
+					ts)
+				b.add(p)
+			}
+		}
+
+	case metrics.Healthcheck:
+		if b.commit && r.runHealthchecks {
+			metric.Check()
+		}
+		htags := make(map[string]string, len(tags)+2)
+		for k, v := range tags {
+			htags[k] = v
+		}
+		healthy := int64(1)
+		htags["status"] = "up"
+		if err := metric.Error(); err != nil {
+			healthy = 0
+			htags["status"] = "down"
+			if msg := r.healthError(err); msg != "" {
+				htags["error"] = msg
+			}
+		}
+		p := r.newPoint(measurement,
+			htags,
+			b.field(r.fieldKey(field, "healthy"), healthy),
+			ts)
+		b.add(p)
+	case metrics.Timer:
+		ms := metric.Snapshot()
+		ps := ms.Percentiles([]float64{0.5, 0.75, 0.95, 0.99, 0.999, 0.9999})
+		fields := map[string]float64{
+			"count":    float64(ms.Count()),
+			"max":      float64(ms.Max()),
+			"mean":     ms.Mean(),
+			"min":      float64(ms.Min()),
+			"stddev":   ms.StdDev(),
+			"variance": ms.Variance(),
+			"p50":      ps[0],
+			"p75":      ps[1],
+			"p95":      ps[2],
+			"p99":      ps[3],
+			"p999":     ps[4],
+			"p9999":    ps[5],
+		}
+		if !r.noTimerRates {
+			fields["m1"] = ms.Rate1()
+			fields["m5"] = ms.Rate5()
+			fields["m15"] = ms.Rate15()
+			fields["meanrate"] = ms.RateMean()
+		}
+		for k := range r.omitStats {
+			delete(fields, k)
+		}
+		if r.isIdle(name, ms.Count(), b.commit) {
+			fields = map[string]float64{"count": fields["count"]}
+		}
+		if r.splitTimers {
+			rates := map[string]float64{"count": fields["count"]}
+			for k, rk := range map[string]string{"m1": "m1", "m5": "m5", "m15": "m15", "meanrate": "mean"} {
+				if v, ok := fields[k]; ok {
+					rates[rk] = v
+					delete(fields, k)
+				}
+			}
+			dist, rated := r.timerDistMeasurement, r.timerRatesMeasurement
+			if dist == "" {
+				dist = stats
+			}
+			if rated == "" {
+				rated = stats
+			}
+			r.addStats(b, dist, field, "histogram", tags, fields, ts)
+			r.addStats(b, rated, field, "meter", tags, rates, ts)
+			break
+		}
+		r.addStats(b, stats, field, "timer", tags, fields, ts)
+	}
+}
+
+// quantiles maps the percentile statistics to their quantile, the value of
+// the tag set by WithQuantileTag.
+var quantiles = map[string]string{
+	"p50":   "0.5",
+	"p75":   "0.75",
+	"p95":   "0.95",
+	"p99":   "0.99",
+	"p999":  "0.999",
+	"p9999": "0.9999",
+}
+
+// evalFunctional returns a snapshot of i when it is a functional gauge,
+// evaluating its function in a goroutine bounded by the metric timeout. A
+// function that hangs is left running, the goroutine exits once it returns.
+func (r *Reporter) evalFunctional(i interface{}) (interface{}, error) {
+	// NewFunctionalGauge and NewFunctionalGaugeFloat64 return pointers.
+	switch i.(type) {
+	case *metrics.FunctionalGauge, *metrics.FunctionalGaugeFloat64,
+		metrics.FunctionalGauge, metrics.FunctionalGaugeFloat64:
+	default:
+		return i, nil
+	}
+	type result struct {
+		snapshot interface{}
+		err      error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				done <- result{err: fmt.Errorf("panic while building points: %v", err)}
+			}
+		}()
+		switch g := i.(type) {
+		case metrics.Gauge:
+			done <- result{snapshot: g.Snapshot()}
+		case metrics.GaugeFloat64:
+			done <- result{snapshot: g.Snapshot()}
+		}
+	}()
+	t := time.NewTimer(r.metricTimeout)
+	defer t.Stop()
+	select {
+	case res := <-done:
+		return res.snapshot, res.err
+	case <-t.C:
+		return nil, fmt.Errorf("gauge evaluation exceeded %v", r.metricTimeout)
+	}
+}
+
+// gaugeTimestamp returns the timestamp of a gauge point timestamped ts, the
+// unique timestamp of the flush for AlignCollisionOffset.
+func (r *Reporter) gaugeTimestamp(b *batch, ts time.Time) time.Time {
+	if b.gaugeTime.IsZero() || !ts.Equal(b.now) {
+		return ts
+	}
+	return b.gaugeTime
+}
+
+// counterNameTags matches name against the counter name patterns, returning
+// the measurement and the tags, added to tags, extracted by the first pattern
+// matching it.
+func (r *Reporter) counterNameTags(name string, tags map[string]string) (string, map[string]string, bool) {
+	for _, rule := range r.counterRules {
+		match := rule.FindStringSubmatch(name)
+		if match == nil {
+			continue
+		}
+		extracted := make(map[string]string, len(tags)+len(match))
+		for k, v := range tags {
+			extracted[k] = v
+		}
+		var measurement string
+		for i, group := range rule.SubexpNames() {
+			switch group {
+			case "":
+			case "measurement":
+				measurement = match[i]
+			default:
+				extracted[group] = match[i]
+			}
+		}
+		return measurement, extracted, true
+	}
+	return "", nil, false
+}
+
+// hasGroup reports whether rule has a group named name.
+func hasGroup(rule *regexp.Regexp, name string) bool {
+	for _, group := range rule.SubexpNames() {
+		if group == name {
+			return true
+		}
+	}
+	return false
+}
+
+// splitPrefix splits a hierarchical metric name after its depth-th dot, e.g.
+// db.query.latency at depth 1 into db and query.latency. It reports false if
+// the name has no segment left after the prefix.
+func splitPrefix(name string, depth int) (prefix, rest string, ok bool) {
+	i := -1
+	for ; depth > 0; depth-- {
+		j := strings.IndexByte(name[i+1:], '.')
+		if j < 0 {
+			return "", "", false
+		}
+		i += j + 1
+	}
+	if i+1 == len(name) {
+		return "", "", false
+	}
+	return name[:i], name[i+1:], true
+}
+
+// addBuckets adds the sum and the cumulative bucket counts of a histogram to
+// its statistics: le_<bound> is the number of samples less than or equal to
+// bound, le_+Inf the count. The counts are estimated from the samples kept
+// by the histogram, of which at most maxBucketSamples are read when positive.
+func (r *Reporter) addBuckets(fields map[string]float64, ms metrics.Histogram) {
+	fields["sum"] = float64(ms.Sum())
+	fields["le_+Inf"] = float64(ms.Count())
+
+	values := ms.Sample().Values()
+	if r.maxBucketSamples > 0 && len(values) > r.maxBucketSamples {
+		values = values[:r.maxBucketSamples]
+	}
+	for _, bound := range r.histogramBounds {
+		var n int
+		for _, v := range values {
+			if float64(v) <= bound {
+				n++
+			}
+		}
+		var count float64
+		if len(values) > 0 {
+			count = math.Round(float64(n) / float64(len(values)) * float64(ms.Count()))
+		}
+		fields["le_"+strconv.FormatFloat(bound, 'g', -1, 64)] = count
+	}
+}
+
+// addStats adds a point per statistic of a histogram, meter or timer to
+// measurement, with the statistic in the bucket tag, or the quantile in the
+// quantile tag for percentiles when it is set.
+func (r *Reporter) addStats(b *batch, measurement, name, kind string, tags map[string]string, fields map[string]float64, ts time.Time) {
+	if measurement == "" {
+		measurement = r.statsMeasurement()
+	}
+	key := r.fieldKey(name, kind)
+	btags := bucketTags(tags)
+	var qtags map[string]string
+	for k, v := range fields {
+		if q, ok := quantiles[k]; ok && r.quantileTag != "" {
+			if qtags == nil {
+				qtags = bucketTags(tags)
+			}
+			qtags[r.quantileTag] = q
+			b.add(r.newPoint(measurement, qtags, b.field(key, v), ts))
+			continue
+		}
+		stat := r.statName(k)
+		btags["bucket"] = stat
+		p := r.newPoint(measurement,
+			btags,
+			b.field(r.statKey(name, kind, key, stat), v),
+			ts)
+		b.add(p)
+	}
+}
+
+// healthError returns the message of a healthcheck error as a tag value:
+// control characters are replaced with spaces and runs of digits, which vary
+// between occurrences of the same error, with a single #, so that the tag
+// keeps a low cardinality. The message is truncated to the configured length.
+func (r *Reporter) healthError(err error) string {
+	var sb strings.Builder
+	digits := false
+	for _, c := range err.Error() {
+		switch {
+		case unicode.IsDigit(c):
+			if !digits {
+				sb.WriteByte('#')
+			}
+			digits = true
+			continue
+		case unicode.IsControl(c):
+			c = ' '
+		}
+		digits = false
+		sb.WriteRune(c)
+	}
+	msg := strings.TrimSpace(sb.String())
+	if len(msg) > r.healthErrorLen {
+		msg = msg[:r.healthErrorLen]
+		for !utf8.ValidString(msg) {
+			msg = msg[:len(msg)-1]
+		}
+		msg = strings.TrimSpace(msg)
+	}
+	return msg
+}
+
+// unchanged reports whether the fields of the points of the named metric are
+// the same as when it was last written, less than maxStale ago. Otherwise it
+// remembers them as written now.
+func (r *Reporter) unchanged(name string, points []*write.Point, now time.Time) bool {
+	h := fnv.New64a()
+	for _, p := range points {
+		for _, f := range p.FieldList() {
+			v, _ := encodeFieldValue(f.Value)
+			io.WriteString(h, f.Key+"="+v+"\n")
+		}
+	}
+	sum := int64(h.Sum64())
+	prev, ok := r.changeHashes.swap(name, sum, true)
+	written, _ := r.changeTimes.swap(name, 0, false)
+	if ok && prev == sum && now.Sub(time.Unix(0, written)) < r.maxStale {
+		r.changeTimes.swap(name, written, true)
+		return true
+	}
+	r.changeTimes.swap(name, now.UnixNano(), true)
+	return false
+}
+
+// every returns the number of flushes the named metric is reported once in,
+// as set by its name or else its type.
+func (r *Reporter) every(name string, t MetricType, typed bool) int64 {
+	if n, ok := r.everyNames[name]; ok {
+		return n
+	}
+	if typed {
+		return r.everyTypes[t]
+	}
+	return 0
+}
+
+// metricTags returns the tags of the points of the named metric: tags
+// without the opt-in tags the metric did not opt into, plus the name tag.
+func (r *Reporter) metricTags(name string, tags map[string]string) map[string]string {
+	var omit []string
+	for _, k := range r.optInTags {
+		if _, ok := tags[k]; ok && !r.optInAllow(name, k) {
+			omit = append(omit, k)
+		}
+	}
+	if len(omit) == 0 && r.nameTag == "" {
+		return tags
+	}
+	m := make(map[string]string, len(tags)+1)
+	for k, v := range tags {
+		m[k] = v
+	}
+	for _, k := range omit {
+		delete(m, k)
+	}
+	if r.nameTag != "" {
+		m[r.nameTag] = name
+	}
+	return m
+}
+
+// fieldKey returns the key of the field holding the value of the named
+// metric, suffixed with its type.
+func (r *Reporter) fieldKey(name, suffix string) string {
+	if r.fieldTmpl != nil {
+		return r.templateKey(name, suffix, suffix)
+	}
+	if r.defaultFieldKey != "" {
+		return r.defaultFieldKey
+	}
+	return name + "." + suffix
+}
+
+// statKey returns the key of the field holding the given statistic of the
+// named histogram, meter or timer, whose fieldKey is key. The statistic is
+// carried by the bucket tag, it is only added to the key of the default field
+// key, or by the field template.
+func (r *Reporter) statKey(name, kind, key, stat string) string {
+	if r.fieldTmpl != nil {
+		return r.templateKey(name, kind, stat)
+	}
+	if r.defaultFieldKey != "" {
+		return key + "." + stat
+	}
+	return key
+}
+
+// fieldData is the data of the field template.
+type fieldData struct {
+	// Name is the metric name.
+	Name string
+	// Type is the type suffix: count, gauge, histogram, meter, timer or
+	// healthy, as overridden by WithCounterField and WithGaugeField.
+	Type string
+	// Stat is the statistic of a histogram, meter or timer, e.g. p99, or the
+	// type suffix for other metrics.
+	Stat string
+}
+
+// templateKey returns the field key produced by the field template. The
+// template was checked by New, should it still fail the key is derived from
+// name and stat.
+func (r *Reporter) templateKey(name, kind, stat string) string {
+	var sb strings.Builder
+	if err := r.fieldTmpl.Execute(&sb, fieldData{Name: name, Type: kind, Stat: stat}); err != nil {
+		return name + "." + stat
+	}
+	return sb.String()
+}
+
+// statName returns the name under which the given statistic is written, as
+// renamed with WithStatNames.
+func (r *Reporter) statName(stat string) string {
+	if name, ok := r.statNames[stat]; ok {
+		return name
+	}
+	return stat
+}
+
+// statsMeasurement returns the measurement of the per-statistic points of
+// histograms, meters and timers.
+func (r *Reporter) statsMeasurement() string {
+	if r.statsMeasurementName != "" {
+		return r.statsMeasurementName
+	}
+	return r.measurement
+}
+
+// counterValue returns the field value of a counter.
+func (r *Reporter) counterValue(v int64) interface{} {
+	if r.floatCounters {
+		return float64(v)
+	}
+	return v
+}
+
+// gaugeValue returns the field value of an integer gauge.
+func (r *Reporter) gaugeValue(v int64) interface{} {
+	if r.gaugeFieldType == FieldFloat {
+		return float64(v)
+	}
+	return v
+}
+
+// gaugeFloat64Value returns the field value of a float gauge.
+func (r *Reporter) gaugeFloat64Value(v float64) interface{} {
+	if r.gaugeFieldType == FieldInt {
+		return int64(v)
+	}
+	return v
+}
+
+// metricError reports an error building the points of the named metric.
+func (r *Reporter) metricError(name string, err error) {
+	if r.metricErrorHandler != nil {
+		r.metricErrorHandler(name, err)
+		return
+	}
+	r.logf("unable to report metric %s. err=%v", name, err)
+}
+
+// internalTags returns the tags of the points about the reporter itself: the
+// global tags plus the reporter tags.
+func (r *Reporter) internalTags() map[string]string {
+	if len(r.reporterTags) == 0 {
+		return r.tags
+	}
+	tags := make(map[string]string, len(r.tags)+len(r.reporterTags))
+	for k, v := range r.tags {
+		tags[k] = v
+	}
+	for k, v := range r.reporterTags {
+		tags[k] = v
+	}
+	return tags
+}
+
+// infoPoint builds the point written once at startup by WithInfoPoint.
+func (r *Reporter) infoPoint(now time.Time) *write.Point {
+	tags := make(map[string]string, len(r.tags)+len(r.reporterTags)+len(r.infoTags)+1)
+	for k, v := range r.internalTags() {
+		tags[k] = v
+	}
+	tags["go_version"] = runtime.Version()
+	for k, v := range r.infoTags {
+		tags[k] = v
+	}
+	measurement := r.infoMeasurement
+	if measurement == "" {
+		measurement = r.measurement
+	}
+	return r.newPoint(measurement, tags, map[string]interface{}{"info": 1}, now)
+}
+
+// isIdle reports whether the distribution of a histogram or timer can be
+// skipped because its count did not change since the previous flush.
+func (r *Reporter) isIdle(name string, count int64, commit bool) bool {
+	if r.idleCounts == nil {
+		return false
+	}
+	prev, ok := r.idleCounts.swap(name, count, commit)
+	return ok && prev == count
+}
+
+// caches returns the per-metric caches, nil for those disabled.
+func (r *Reporter) caches() []*countCache {
+	return []*countCache{
+		r.meterRates, r.meterRateTimes, r.idleCounts, r.counterDeltas, r.counterTotals, r.meterDeltas,
+		r.flushCounts, r.changeHashes, r.changeTimes, r.gaugeDeltas,
+	}
+}
+
+// pruneCaches drops the cached values of metrics that were not seen during
+// the flush.
+func (r *Reporter) pruneCaches() {
+	for _, c := range r.caches() {
+		if c != nil {
+			c.prune()
+		}
+	}
+}
+
+// keepCaches keeps the cached values of a metric skipped by the flush, so that
+// the deltas reported once it is reported again are computed from its last
+// reported values rather than from zero.
+func (r *Reporter) keepCaches(name string) {
+	for _, c := range r.caches() {
+		if c != nil {
+			c.keep(name)
+		}
+	}
+}
+
+// bucketTags returns a copy of tags with room for the bucket tag. NewPoint
+// copies the tags it is given, so the copy is shared by all the per-field
+// points of a metric and only its bucket key is changed in between.
+func bucketTags(tags map[string]string) map[string]string {
+	m := make(map[string]string, len(tags)+1)
+	for tk, tv := range tags {
+		m[tk] = tv
+	}
+	return m
+}
@@ -0,0 +1,250 @@
+package influxdb
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+func TestMetricTimeoutSkipsHangingGauge(t *testing.T) {
+	reg := metrics.NewRegistry()
+	block := make(chan struct{})
+	defer close(block)
+	reg.Register("slow", metrics.NewFunctionalGauge(func() int64 {
+		<-block
+		return 1
+	}))
+	reg.Register("fast", metrics.NewFunctionalGauge(func() int64 { return 2 }))
+	reg.Register("ratio", metrics.NewFunctionalGaugeFloat64(func() float64 { return 0.5 }))
+
+	var (
+		mu      sync.Mutex
+		skipped []string
+	)
+	r := newTestReporter(t, reg, time.Minute,
+		WithMetricTimeout(10*time.Millisecond),
+		WithMetricErrorHandler(func(name string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			skipped = append(skipped, name)
+		}))
+
+	done := make(chan *batch, 1)
+	go func() { done <- r.points(time.Now(), false) }()
+	var b *batch
+	select {
+	case b = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the hanging gauge blocked the flush")
+	}
+
+	if v, ok := fieldValue(b.points, "fast.gauge", ""); !ok || v != int64(2) {
+		t.Errorf("fast.gauge = %v, %v, want 2", v, ok)
+	}
+	if v, ok := fieldValue(b.points, "ratio.gauge", ""); !ok || v != 0.5 {
+		t.Errorf("ratio.gauge = %v, %v, want 0.5", v, ok)
+	}
+	if _, ok := fieldValue(b.points, "slow.gauge", ""); ok {
+		t.Error("slow.gauge was reported")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(skipped) != 1 || skipped[0] != "slow" {
+		t.Errorf("skipped = %v, want [slow]", skipped)
+	}
+}
+
+func TestTypeOptionsOrder(t *testing.T) {
+	reg := metrics.NewRegistry()
+	metrics.GetOrRegisterCounter("requests", reg).Inc(1)
+	metrics.GetOrRegisterGauge("queue", reg).Update(2)
+	metrics.GetOrRegisterGaugeFloat64("ratio", reg).Update(0.5)
+	enable := WithEnabledTypes(Counter, Gauge)
+	disable := WithDisabledTypes(Gauge)
+
+	for name, opts := range map[string][]Option{
+		"enabled first":  {enable, disable},
+		"disabled first": {disable, enable},
+	} {
+		b := newTestReporter(t, reg, time.Minute, opts...).points(time.Now(), false)
+		if _, ok := fieldValue(b.points, "requests.count", ""); !ok {
+			t.Errorf("%s: the enabled counter was skipped", name)
+		}
+		if _, ok := fieldValue(b.points, "queue.gauge", ""); ok {
+			t.Errorf("%s: the disabled gauge was reported", name)
+		}
+		if _, ok := fieldValue(b.points, "ratio.gauge", ""); ok {
+			t.Errorf("%s: the float gauge, not enabled, was reported", name)
+		}
+	}
+}
+
+func TestSampleSeedDeterministic(t *testing.T) {
+	reg := metrics.NewRegistry()
+	metrics.GetOrRegisterCounter("requests", reg).Inc(1)
+	opts := []Option{WithSampleRate("requests", 0.5), WithSampleSeed(42)}
+
+	// sampled returns which of n flushes reported the counter, rendering the
+	// registry over HTTP before each of them if serve is set.
+	sampled := func(serve bool, n int) []bool {
+		r := newTestReporter(t, reg, time.Minute, opts...)
+		now := time.Now()
+		var reported []bool
+		for i := 0; i < n; i++ {
+			if serve {
+				rec := httptest.NewRecorder()
+				r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+				if !strings.Contains(rec.Body.String(), "requests.count=") {
+					t.Fatalf("the sampled counter was not served: %q", rec.Body.String())
+				}
+			}
+			b := r.points(now.Add(time.Duration(i)*time.Minute), true)
+			_, ok := fieldValue(b.points, "requests.count", "")
+			reported = append(reported, ok)
+		}
+		return reported
+	}
+
+	want := sampled(false, 32)
+	var count int
+	for _, ok := range want {
+		if ok {
+			count++
+		}
+	}
+	if count == 0 || count == len(want) {
+		t.Fatalf("the counter was reported by %d of %d flushes, want some sampled out", count, len(want))
+	}
+	for _, serve := range []bool{false, true} {
+		if got := sampled(serve, len(want)); !reflect.DeepEqual(got, want) {
+			t.Errorf("serve %v: reported %v, want %v with the same seed", serve, got, want)
+		}
+	}
+}
+
+func TestMeterCountDeltas(t *testing.T) {
+	reg := metrics.NewRegistry()
+	meter := metrics.NewMeter()
+	reg.Register("requests", meter)
+	r := newTestReporter(t, reg, time.Minute, WithMeterCountDeltas())
+
+	now := time.Now()
+	meter.Mark(5)
+	b := r.points(now, true)
+	if v, ok := fieldValue(b.points, "requests.meter", "count"); !ok || v != 5.0 {
+		t.Errorf("first flush count = %v, %v, want 5", v, ok)
+	}
+
+	meter.Mark(3)
+	b = r.points(now.Add(time.Minute), true)
+	if v, ok := fieldValue(b.points, "requests.meter", "count"); !ok || v != 3.0 {
+		t.Errorf("second flush count = %v, %v, want the increase 3", v, ok)
+	}
+}
+
+func TestConcurrencyPointsMatchSerial(t *testing.T) {
+	reg := metrics.NewRegistry()
+	meters := make([]metrics.Meter, 4)
+	for i := range meters {
+		name := strconv.Itoa(i)
+		metrics.GetOrRegisterCounter("counter"+name, reg).Inc(int64(i))
+		metrics.GetOrRegisterGauge("gauge"+name, reg).Update(int64(i))
+		meters[i] = metrics.GetOrRegisterMeter("meter"+name, reg)
+	}
+	opts := []Option{
+		WithAlign(),
+		WithDisableAlignForCounters(),
+		WithAlignCollision(AlignCollisionOffset),
+		WithMeterIntervalRate(),
+	}
+
+	serial := newTestReporter(t, reg, time.Minute, opts...)
+	concurrent := newTestReporter(t, reg, time.Minute, append(opts, WithConcurrency(4))...)
+	lines := func(r *Reporter, now time.Time) string {
+		var lines []string
+		for _, p := range r.points(now, true).points {
+			lines = append(lines, pointLine(p))
+		}
+		sort.Strings(lines)
+		return strings.Join(lines, "\n")
+	}
+
+	// Two flushes sharing an aligned timestamp, e.g. a tick and a Flush.
+	aligned := time.Unix(1600000000, 0)
+	for i, wall := range []time.Time{aligned.Add(time.Second), aligned.Add(11 * time.Second)} {
+		wall := wall
+		serial.clock = func() time.Time { return wall }
+		concurrent.clock = serial.clock
+		for _, m := range meters {
+			m.Mark(int64(i + 1))
+		}
+		want := lines(serial, aligned)
+		if got := lines(concurrent, aligned); got != want {
+			t.Errorf("flush %d with concurrency 4:\n%s\nwant:\n%s", i, got, want)
+		}
+	}
+}
+
+// benchmarkPoints reports the time and allocations of building the points of
+// a flush of reg.
+func benchmarkPoints(b *testing.B, reg metrics.Registry, opts ...Option) {
+	r := newTestReporter(b, reg, time.Minute, opts...)
+	now := time.Now()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.points(now, false)
+	}
+}
+
+func BenchmarkPointsTimers(b *testing.B) {
+	reg := metrics.NewRegistry()
+	for i := 0; i < 100; i++ {
+		timer := metrics.GetOrRegisterTimer("timer"+strconv.Itoa(i), reg)
+		for j := 0; j < 100; j++ {
+			timer.Update(time.Duration(j) * time.Millisecond)
+		}
+	}
+	benchmarkPoints(b, reg, WithTags(map[string]string{"host": "a", "env": "prod", "region": "eu"}))
+}
+
+func BenchmarkPointsCounters(b *testing.B) {
+	for _, n := range []int{1000, 10000} {
+		reg := metrics.NewRegistry()
+		for i := 0; i < n; i++ {
+			metrics.GetOrRegisterCounter("counter"+strconv.Itoa(i), reg).Inc(int64(i))
+		}
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			benchmarkPoints(b, reg)
+		})
+	}
+}
+
+func BenchmarkPointsConcurrency(b *testing.B) {
+	reg := metrics.NewRegistry()
+	for i := 0; i < 50000; i++ {
+		name := strconv.Itoa(i)
+		switch i % 3 {
+		case 0:
+			metrics.GetOrRegisterCounter("counter"+name, reg).Inc(int64(i))
+		case 1:
+			metrics.GetOrRegisterGauge("gauge"+name, reg).Update(int64(i))
+		default:
+			metrics.GetOrRegisterGaugeFloat64("ratio"+name, reg).Update(float64(i) / 2)
+		}
+	}
+	b.Run("serial", func(b *testing.B) {
+		benchmarkPoints(b, reg)
+	})
+	b.Run("concurrent", func(b *testing.B) {
+		benchmarkPoints(b, reg, WithConcurrency(4))
+	})
+}
@@ -0,0 +1,63 @@
+package influxdb
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// Sink receives the points of every flush instead of InfluxDB, e.g. to
+// produce them as line protocol to a queue consumed by Telegraf.
+type Sink interface {
+	// Write writes the points of a flush within the deadline of ctx.
+	Write(ctx context.Context, points []*write.Point) error
+}
+
+// RecordSink is a Sink which also accepts line protocol records, those of
+// WriteRecords and EnqueueRecords.
+type RecordSink interface {
+	Sink
+	// WriteRecords writes line protocol records within the deadline of ctx.
+	WriteRecords(ctx context.Context, records []string) error
+}
+
+// ErrRecordsUnsupported is returned when records are written or enqueued
+// while the reporter writes to a sink which is not a RecordSink.
+var ErrRecordsUnsupported = errors.New("influxdb: writing records is not supported by the sink")
+
+// sinkWriter writes to a Sink. The org and bucket are ignored, the sink
+// decides where the points go. A sink implementing io.Closer is closed with
+// the reporter.
+type sinkWriter struct {
+	sink Sink
+}
+
+func (w sinkWriter) writePoints(ctx context.Context, org, bucket string, points []*write.Point) error {
+	return w.sink.Write(ctx, points)
+}
+
+func (w sinkWriter) writeRecords(ctx context.Context, org, bucket string, records []string) error {
+	if rs, ok := w.sink.(RecordSink); ok {
+		return rs.WriteRecords(ctx, records)
+	}
+	return ErrRecordsUnsupported
+}
+
+// busy is always false, sink writes complete within send.
+func (w sinkWriter) busy() bool {
+	return false
+}
+
+// ready is always true, a sink has no readiness to check.
+func (w sinkWriter) ready(ctx context.Context) (bool, error) {
+	return true, nil
+}
+
+func (w sinkWriter) close() error {
+	if c, ok := w.sink.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
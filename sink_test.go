@@ -0,0 +1,134 @@
+package influxdb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"github.com/rcrowley/go-metrics"
+)
+
+// failingCloseSink is a sink whose Close fails.
+type failingCloseSink struct{}
+
+func (failingCloseSink) Write(ctx context.Context, points []*write.Point) error { return nil }
+
+func (failingCloseSink) Close() error { return errors.New("broker unreachable") }
+
+// syncBuffer is a buffer safe for concurrent use by a logger.
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+func TestSinkCloseErrorLogged(t *testing.T) {
+	var logs syncBuffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	r := newTestReporter(t, metrics.NewRegistry(), time.Hour, WithSink(failingCloseSink{}))
+
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := r.StopAndWait(ctx); err != nil {
+		t.Fatalf("StopAndWait: %v", err)
+	}
+	if !strings.Contains(logs.String(), "broker unreachable") {
+		t.Errorf("the Close error was not logged, got logs:\n%s", logs.String())
+	}
+}
+
+// recordSink records the records written to it.
+type recordSink struct {
+	mu      sync.Mutex
+	records []string
+}
+
+func (s *recordSink) Write(ctx context.Context, points []*write.Point) error { return nil }
+
+func (s *recordSink) WriteRecords(ctx context.Context, records []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, records...)
+	return nil
+}
+
+func TestSinkRecords(t *testing.T) {
+	r := newTestReporter(t, metrics.NewRegistry(), time.Minute, WithSink(failingCloseSink{}))
+	if err := r.EnqueueRecords("worker,pid=1 up=1i"); err != ErrRecordsUnsupported {
+		t.Errorf("EnqueueRecords to a Sink = %v, want ErrRecordsUnsupported", err)
+	}
+
+	sink := &recordSink{}
+	r = newTestReporter(t, metrics.NewRegistry(), time.Minute, WithSink(sink))
+	if err := r.EnqueueRecords("worker,pid=1 up=1i"); err != nil {
+		t.Fatalf("EnqueueRecords to a RecordSink: %v", err)
+	}
+	if err := r.send(); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if len(sink.records) != 1 || sink.records[0] != "worker,pid=1 up=1i" {
+		t.Errorf("records = %q, want the enqueued record", sink.records)
+	}
+}
+
+// flakySink fails its first write and records the points of the others.
+type flakySink struct {
+	mu     sync.Mutex
+	calls  int
+	writes [][]*write.Point
+}
+
+func (s *flakySink) Write(ctx context.Context, points []*write.Point) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.calls++; s.calls == 1 {
+		return errors.New("InfluxDB is starting")
+	}
+	s.writes = append(s.writes, points)
+	return nil
+}
+
+func TestInfoPointRetriedAfterFailedWrite(t *testing.T) {
+	sink := &flakySink{}
+	r := newTestReporter(t, metrics.NewRegistry(), time.Minute,
+		WithSink(sink), WithInfoPoint(map[string]string{"version": "1.2.3"}))
+
+	if err := r.send(); err == nil {
+		t.Fatal("the first flush succeeded")
+	}
+	for i := 0; i < 2; i++ {
+		if err := r.send(); err != nil {
+			t.Fatalf("flush %d: %v", i+2, err)
+		}
+	}
+	if v, ok := fieldValue(sink.writes[0], "info", ""); !ok || v != int64(1) {
+		t.Errorf("info = %v, %v in the first successful flush, want 1", v, ok)
+	}
+	if _, ok := fieldValue(sink.writes[1], "info", ""); ok {
+		t.Error("the info point was written again")
+	}
+}
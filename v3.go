@@ -0,0 +1,117 @@
+package influxdb
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	nethttp "net/http"
+	uurl "net/url"
+	"strings"
+	"time"
+
+	"github.com/influxdata/influxdb-client-go/v2/api/http"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// v3Writer writes line protocol to the write endpoint of InfluxDB 3, which
+// addresses a database instead of an org and a bucket.
+type v3Writer struct {
+	r      *Reporter
+	client *nethttp.Client
+}
+
+func newV3Writer(r *Reporter) *v3Writer {
+	c := &nethttp.Client{}
+	if r.tlsConfig != nil {
+		t := nethttp.DefaultTransport.(*nethttp.Transport).Clone()
+		t.TLSClientConfig = r.tlsConfig
+		c.Transport = t
+	}
+	return &v3Writer{r: r, client: c}
+}
+
+func (w *v3Writer) writePoints(ctx context.Context, org, bucket string, points []*write.Point) error {
+	records := make([]string, len(points))
+	for i, p := range points {
+		records[i] = strings.TrimSuffix(write.PointToLineProtocol(p, time.Nanosecond), "\n")
+	}
+	return w.writeRecords(ctx, org, bucket, records)
+}
+
+// writeRecords writes records to the database named bucket, org is ignored.
+func (w *v3Writer) writeRecords(ctx context.Context, org, bucket string, records []string) error {
+	if len(records) == 0 {
+		return nil
+	}
+	u := w.endpoint("/api/v3/write_lp")
+	q := u.Query()
+	q.Set("db", bucket)
+	q.Set("precision", "nanosecond")
+	u.RawQuery = q.Encode()
+
+	body := strings.Join(records, "\n")
+	req, err := nethttp.NewRequest(nethttp.MethodPost, u.String(), bytes.NewBufferString(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	return w.do(ctx, req)
+}
+
+// busy is always false, v3 writes complete within send.
+func (w *v3Writer) busy() bool {
+	return false
+}
+
+func (w *v3Writer) ready(ctx context.Context) (bool, error) {
+	u := w.endpoint("/health")
+	req, err := nethttp.NewRequest(nethttp.MethodGet, u.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	if err := w.do(ctx, req); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (w *v3Writer) close() error {
+	w.client.CloseIdleConnections()
+	return nil
+}
+
+// endpoint returns the url of the given path on the InfluxDB server.
+func (w *v3Writer) endpoint(path string) uurl.URL {
+	w.r.mu.RLock()
+	u := w.r.url
+	w.r.mu.RUnlock()
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	return u
+}
+
+// do sends req with the reporter's token, turning non-2xx responses into
+// errors of the same type as the ones returned by the v2 client.
+func (w *v3Writer) do(ctx context.Context, req *nethttp.Request) error {
+	w.r.mu.RLock()
+	token := w.r.token
+	w.r.mu.RUnlock()
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := w.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return &http.Error{Err: err, Message: err.Error()}
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode/100 != 2 {
+		return &http.Error{
+			StatusCode: resp.StatusCode,
+			Code:       nethttp.StatusText(resp.StatusCode),
+			Message:    strings.TrimSpace(string(msg)),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,343 @@
+package influxdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	nethttp "net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	client "github.com/influxdata/influxdb-client-go/v2"
+	"github.com/influxdata/influxdb-client-go/v2/api"
+	"github.com/influxdata/influxdb-client-go/v2/api/http"
+	"github.com/influxdata/influxdb-client-go/v2/api/write"
+)
+
+// writer is the write path to a flavour of InfluxDB. Points are built the same
+// way whatever the flavour, only the way they are transported differs.
+type writer interface {
+	// writePoints writes points to bucket in org, within the deadline of ctx.
+	writePoints(ctx context.Context, org, bucket string, points []*write.Point) error
+	// writeRecords writes line protocol records to bucket in org.
+	writeRecords(ctx context.Context, org, bucket string, records []string) error
+	// busy reports whether a previous write is still in progress.
+	busy() bool
+	// ready reports whether InfluxDB is ready to accept writes.
+	ready(ctx context.Context) (bool, error)
+	// close releases the resources of the writer after flushing its buffers.
+	close() error
+}
+
+// v2Writer writes through the asynchronous write API of the InfluxDB v2
+// client, which also serves InfluxDB 1.8+, or through its blocking write API
+// when blocking is set. Blocking writes are used by the options which need
+// the outcome of a flush, such as WithRetries, WithWriteCallback and
+// WithScrapeStatus: a flush then only succeeds once InfluxDB stored its
+// points, and its write errors are returned by the flush rather than
+// reported later, while the client no longer retries failed writes by itself.
+type v2Writer struct {
+	r        *Reporter
+	blocking bool
+}
+
+func (w v2Writer) writePoints(ctx context.Context, org, bucket string, points []*write.Point) error {
+	if !w.blocking {
+		return w.r.handOver(ctx, w.r.writeAPI(org, w.r.withRetentionPolicy(bucket)), points)
+	}
+	if len(points) == 0 {
+		return nil
+	}
+	w.r.mu.RLock()
+	writeAPI := w.r.client.WriteAPIBlocking(org, w.r.withRetentionPolicy(bucket))
+	w.r.mu.RUnlock()
+	return writeAPI.WritePoint(ctx, points...)
+}
+
+func (w v2Writer) writeRecords(ctx context.Context, org, bucket string, records []string) error {
+	w.r.mu.RLock()
+	writeAPI := w.r.client.WriteAPIBlocking(org, w.r.withRetentionPolicy(bucket))
+	w.r.mu.RUnlock()
+	return writeAPI.WriteRecord(ctx, records...)
+}
+
+func (w v2Writer) busy() bool {
+	return atomic.LoadInt32(&w.r.writing) == 1
+}
+
+func (w v2Writer) ready(ctx context.Context) (bool, error) {
+	w.r.mu.RLock()
+	defer w.r.mu.RUnlock()
+	return w.r.client.Ready(ctx)
+}
+
+func (w v2Writer) close() error {
+	w.r.mu.RLock()
+	defer w.r.mu.RUnlock()
+	w.r.client.Close()
+	return nil
+}
+
+// withRetentionPolicy returns the bucket to write to for the database
+// bucket, in the database/retention-policy form of the InfluxDB 1.8 write
+// compatibility when a retention policy is set and bucket does not name one.
+func (r *Reporter) withRetentionPolicy(bucket string) string {
+	if r.retentionPolicy == "" || strings.Contains(bucket, "/") {
+		return bucket
+	}
+	return bucket + "/" + r.retentionPolicy
+}
+
+// writeRetrying writes points to bucket in org, retrying the failed writes
+// the retryable error func accepts up to the configured number of times. The
+// delay between attempts starts at the retry backoff and doubles every
+// attempt, all within the deadline of ctx.
+func (r *Reporter) writeRetrying(ctx context.Context, org, bucket string, points []*write.Point) error {
+	backoff := r.retryBackoff
+	for attempt := 0; ; attempt++ {
+		err := r.writer.writePoints(ctx, org, bucket, points)
+		if err == nil || attempt >= r.retries || !r.retryable(err) {
+			return err
+		}
+		r.logf("unable to write metrics to InfluxDB, retrying in %v. err=%v", backoff, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// maxWriteAPIs bounds the write APIs cached for the destinations of a
+// client, each of which runs its own goroutines.
+const maxWriteAPIs = 16
+
+// writeTarget identifies the destination of a write API.
+type writeTarget struct {
+	org, bucket string
+}
+
+// writeAPI returns the write API of the current client for org and bucket,
+// creating it on first use so that a changing destination does not churn the
+// client's internal state every interval. The client keeps its write APIs
+// until it is closed, so once maxWriteAPIs destinations were used, e.g. by a
+// rotating bucket provider, it is recreated before adding another one.
+func (r *Reporter) writeAPI(org, bucket string) api.WriteAPI {
+	t := writeTarget{org: org, bucket: bucket}
+	w, ok := r.writeAPIs[t]
+	if !ok {
+		if len(r.writeAPIs) >= maxWriteAPIs {
+			r.makeClient()
+		}
+		w = r.client.WriteAPI(org, bucket)
+		r.writeAPIs[t] = w
+		if !r.skipErrors {
+			go r.drainErrors(w.Errors())
+		}
+	}
+	return w
+}
+
+// drainErrors hands the asynchronous write errors to the error handler until
+// the write API is closed.
+func (r *Reporter) drainErrors(errs <-chan error) {
+	for err := range errs {
+		r.recordError(err)
+		r.checkAuth(err)
+		r.checkPartialWrite(err)
+		if r.errorHandler != nil {
+			r.sendFailures.failed(time.Now())
+			r.errorHandler(err)
+			continue
+		}
+		r.logFailure("unable to write metrics to InfluxDB", err)
+	}
+}
+
+var (
+	// droppedRE matches the number of points rejected by a partial write.
+	droppedRE = regexp.MustCompile(`dropped=(\d+)`)
+	// conflictRE matches the field and measurement of a field type conflict.
+	conflictRE = regexp.MustCompile(`input field "([^"]*)" on measurement "([^"]*)"`)
+)
+
+// checkPartialWrite counts and logs the points InfluxDB rejected when it only
+// accepted part of a batch, e.g. because of a field type conflict, which
+// helps finding the metric whose type conflicts with an existing series.
+func (r *Reporter) checkPartialWrite(err error) {
+	var herr *http.Error
+	if !errors.As(err, &herr) || !strings.Contains(herr.Message, "partial write") {
+		return
+	}
+	rejected := int64(1)
+	if m := droppedRE.FindStringSubmatch(herr.Message); m != nil {
+		if n, err := strconv.ParseInt(m[1], 10, 64); err == nil {
+			rejected = n
+		}
+	}
+	atomic.AddInt64(&r.rejectedPoints, rejected)
+
+	var fields []string
+	for _, m := range conflictRE.FindAllStringSubmatch(herr.Message, -1) {
+		fields = append(fields, m[2]+"."+m[1])
+	}
+	r.logf("InfluxDB rejected %d points of a partial write. fields=%v", rejected, fields)
+}
+
+// RejectedPoints returns the number of points InfluxDB rejected in partially
+// accepted writes.
+func (r *Reporter) RejectedPoints() int64 {
+	return atomic.LoadInt64(&r.rejectedPoints)
+}
+
+// handOver hands points over to the asynchronous write API and flushes it.
+//
+// The write API blocks once its internal buffer is full, e.g. when InfluxDB
+// is slow, so the hand-over runs in its own goroutine and is bounded by the
+// deadline of ctx. Points which could not be handed over in time are dropped
+// and counted, as are the points of a flush started while the previous
+// hand-over is still blocked.
+func (r *Reporter) handOver(ctx context.Context, writeAPI api.WriteAPI, points []*write.Point) error {
+	if !atomic.CompareAndSwapInt32(&r.writing, 0, 1) {
+		atomic.AddInt64(&r.droppedPoints, int64(len(points)))
+		return fmt.Errorf("previous write is still blocked, dropped %d points", len(points))
+	}
+
+	var abort int32
+	done := make(chan struct{})
+	r.mu.Lock()
+	r.handOverDone = done
+	r.mu.Unlock()
+	go func() {
+		// Reset the flag before signalling completion, so that a hand-over
+		// following this one in the same flush does not see it set.
+		defer close(done)
+		defer atomic.StoreInt32(&r.writing, 0)
+		for i, p := range points {
+			if atomic.LoadInt32(&abort) == 1 {
+				atomic.AddInt64(&r.droppedPoints, int64(len(points)-i))
+				return
+			}
+			writeAPI.WritePoint(p)
+		}
+		writeAPI.Flush()
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		atomic.StoreInt32(&abort, 1)
+		return fmt.Errorf("write buffer is full, write did not complete in time: %w", ctx.Err())
+	}
+}
+
+// SkippedTicks returns the number of flushes which were skipped because the
+// previous write was still in progress or which were coalesced by
+// WithMinInterval. A rising count means InfluxDB does not keep up.
+func (r *Reporter) SkippedTicks() int64 {
+	return atomic.LoadInt64(&r.skippedTicks)
+}
+
+// ClampedValues returns the number of field values bounded by
+// WithFieldValueClamp.
+func (r *Reporter) ClampedValues() int64 {
+	return atomic.LoadInt64(&r.clampedValues)
+}
+
+// DroppedPoints returns the number of points dropped because the write
+// buffer stayed full for longer than the write timeout, because the queue of
+// Enqueue was full or because they exceeded the WithMaxPointSize limit.
+func (r *Reporter) DroppedPoints() int64 {
+	return atomic.LoadInt64(&r.droppedPoints)
+}
+
+// WriteRecords writes pre-formatted line protocol records to the reporter's
+// org and bucket, reusing the reporter's connection and credentials.
+func (r *Reporter) WriteRecords(ctx context.Context, records ...string) error {
+	r.mu.RLock()
+	org, bucket := r.org, r.bucket
+	r.mu.RUnlock()
+	return r.writer.writeRecords(ctx, org, bucket, records)
+}
+
+// Enqueue queues a point, e.g. a deploy marker, to be written by the next
+// flush together with the metrics. Points enqueued while the queue holds
+// the WithEnqueueLimit maximum are dropped and counted in DroppedPoints.
+func (r *Reporter) Enqueue(p *write.Point) {
+	r.queueMu.Lock()
+	defer r.queueMu.Unlock()
+	if len(r.queue)+len(r.records) >= r.queueLimit {
+		atomic.AddInt64(&r.droppedPoints, 1)
+		return
+	}
+	r.queue = append(r.queue, p)
+}
+
+// EnqueueRecords queues line protocol records, e.g. received from worker
+// processes, to be forwarded as is by the next flush to the reporter's org and
+// bucket, so that many processes share the reporter's connection to InfluxDB.
+// The records share the queue of Enqueue and its limit. They are written
+// separately from the metrics, so that a malformed record does not fail the
+// write of the metrics. It returns ErrRecordsUnsupported, queuing nothing,
+// when the reporter writes to a sink which is not a RecordSink.
+func (r *Reporter) EnqueueRecords(records ...string) error {
+	if r.sink != nil {
+		if _, ok := r.sink.(RecordSink); !ok {
+			return ErrRecordsUnsupported
+		}
+	}
+	r.queueMu.Lock()
+	defer r.queueMu.Unlock()
+	for _, record := range records {
+		if len(r.queue)+len(r.records) >= r.queueLimit {
+			atomic.AddInt64(&r.droppedPoints, 1)
+			continue
+		}
+		r.records = append(r.records, record)
+	}
+	return nil
+}
+
+// dequeue returns the enqueued points and records and empties the queue.
+func (r *Reporter) dequeue() ([]*write.Point, []string) {
+	r.queueMu.Lock()
+	defer r.queueMu.Unlock()
+	points, records := r.queue, r.records
+	r.queue, r.records = nil, nil
+	return points, records
+}
+
+// consistencyClient returns an HTTP client, configured as the client would
+// configure its own from opts, which sets the given consistency on writes.
+// The client has no write option for it, the write endpoint of InfluxDB
+// Enterprise reads it from the query.
+func consistencyClient(consistency string, opts *client.Options) *nethttp.Client {
+	transport := nethttp.DefaultTransport.(*nethttp.Transport).Clone()
+	transport.TLSClientConfig = opts.TLSConfig()
+	return &nethttp.Client{
+		Timeout:   time.Duration(opts.HTTPRequestTimeout()) * time.Second,
+		Transport: consistencyTransport{consistency: consistency, base: transport},
+	}
+}
+
+// consistencyTransport adds the consistency query parameter to write requests.
+type consistencyTransport struct {
+	consistency string
+	base        nethttp.RoundTripper
+}
+
+func (t consistencyTransport) RoundTrip(req *nethttp.Request) (*nethttp.Response, error) {
+	if !strings.HasSuffix(req.URL.Path, "/write") {
+		return t.base.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	q := req.URL.Query()
+	q.Set("consistency", t.consistency)
+	req.URL.RawQuery = q.Encode()
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,52 @@
+package influxdb
+
+import (
+	nethttp "net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+func TestConsistencyTransport(t *testing.T) {
+	queries := make(chan string, 2)
+	srv := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, req *nethttp.Request) {
+		queries <- req.URL.RawQuery
+		w.WriteHeader(nethttp.StatusNoContent)
+	}))
+	defer srv.Close()
+	c := &nethttp.Client{Transport: consistencyTransport{consistency: "quorum", base: nethttp.DefaultTransport}}
+
+	for _, tc := range []struct {
+		path, want string
+	}{
+		{"/api/v2/write?bucket=db%2Frp&org=org", "bucket=db%2Frp&consistency=quorum&org=org"},
+		{"/ping", ""},
+	} {
+		resp, err := c.Post(srv.URL+tc.path, "text/plain", nil)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.path, err)
+		}
+		resp.Body.Close()
+		if got := <-queries; got != tc.want {
+			t.Errorf("%s: query = %q, want %q", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestWriteAPIsBounded(t *testing.T) {
+	r := newTestReporter(t, metrics.NewRegistry(), time.Minute)
+	for i := 0; i < 3*maxWriteAPIs; i++ {
+		r.writeAPI("org", "tenant"+strconv.Itoa(i))
+		if n := len(r.writeAPIs); n > maxWriteAPIs {
+			t.Fatalf("%d write APIs cached, want at most %d", n, maxWriteAPIs)
+		}
+	}
+	// A cached destination keeps its write API.
+	w := r.writeAPI("org", "tenant")
+	if r.writeAPI("org", "tenant") != w {
+		t.Error("the write API of a cached destination was recreated")
+	}
+}